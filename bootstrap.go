@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// bootstrap files are a gzip stream of:
+// magic(9), version(2), network magic(4), checkpoint(32), checkpoint header(80)
+// per block: 'B', hash(32), previous(32), header(80), fingerprint(32), commit count(var), commits(32 each)
+// trailer: 'E', block count(8), db fingerprint(32)
+const BOOTSTRAP_MAGIC = "COMBCHAIN"
+const BOOTSTRAP_VERSION = 2           //2 added the checkpoint header, the first block cant be checked without it
+const BOOTSTRAP_MAX_COMMITS = 1000000 //more P2WSH outputs than fit in a block
+
+func bootstrap_export(path string) (count uint64, fingerprint [32]byte, err error) {
+	//written to a temporary file first so a half written export is never left under the real name
+	var f *os.File
+	if f, err = os.Create(path + ".tmp"); err != nil {
+		return 0, fingerprint, err
+	}
+	zip := gzip.NewWriter(f)
+	out := bufio.NewWriter(zip)
+
+	var header [127]byte
+	copy(header[0:9], BOOTSTRAP_MAGIC)
+	binary.BigEndian.PutUint16(header[9:11], BOOTSTRAP_VERSION)
+	COMBInfo.Guard.RLock()
+	binary.LittleEndian.PutUint32(header[11:15], COMBInfo.Magic)
+	copy(header[15:47], COMBInfo.Checkpoint[:])
+	var previous [32]byte = COMBInfo.Checkpoint
+	COMBInfo.Guard.RUnlock()
+	checkpoint_header := db_get_checkpoint_header()
+	copy(header[47:127], checkpoint_header[:])
+	out.Write(header[:])
+	if checkpoint_header == [80]byte{} {
+		err = fmt.Errorf("checkpoint header is not known, sync with a BTC peer first")
+	}
+
+	//only blocks an importer can check go out, anything else stops the export (the rest is still read to free the loader)
+	var blocks chan Block = make(chan Block)
+	go db_load_blocks(0, (^uint64(0))-1, blocks)
+	for block := range blocks {
+		if block.Metadata.Hash == [32]byte{} || err != nil {
+			continue //dummy block, or draining after an error
+		}
+		if block.Metadata.Header == [80]byte{} {
+			err = fmt.Errorf("block %d has no header, sync with a BTC peer to fill it in first", block.Metadata.Height)
+			continue
+		}
+		if block.Metadata.Previous != previous {
+			err = fmt.Errorf("block %d does not link to the block before it", block.Metadata.Height)
+			continue
+		}
+		if db_compute_block_fingerprint(block.Commits) != block.Metadata.Fingerprint {
+			err = fmt.Errorf("fingerprint mismatch on block %d", block.Metadata.Height)
+			continue
+		}
+		previous = block.Metadata.Hash
+		out.WriteByte('B')
+		out.Write(block.Metadata.Hash[:])
+		out.Write(block.Metadata.Previous[:])
+		out.Write(block.Metadata.Header[:])
+		out.Write(block.Metadata.Fingerprint[:])
+		out.Write(btc_encode_varint(uint64(len(block.Commits))))
+		for _, commit := range block.Commits {
+			out.Write(commit[:])
+		}
+		fingerprint = xor_hex(fingerprint, block.Metadata.Fingerprint)
+		count++
+		if count%10000 == 0 {
+			log_status("bootstrap", "exported %d blocks", count)
+		}
+	}
+
+	var trailer [41]byte
+	trailer[0] = 'E'
+	binary.BigEndian.PutUint64(trailer[1:9], count)
+	copy(trailer[9:41], fingerprint[:])
+	out.Write(trailer[:])
+
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = zip.Close()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return 0, fingerprint, err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return 0, fingerprint, err
+	}
+	log_status("bootstrap", "exported %d blocks to %s", count, path)
+	return count, fingerprint, nil
+}
+
+func bootstrap_read_varint(in *bufio.Reader) (value uint64, err error) {
+	var prefix byte
+	var data [8]byte
+	if prefix, err = in.ReadByte(); err != nil {
+		return 0, err
+	}
+	switch prefix {
+	case 0xfd:
+		_, err = io.ReadFull(in, data[0:2])
+		value = uint64(binary.LittleEndian.Uint16(data[0:2]))
+	case 0xfe:
+		_, err = io.ReadFull(in, data[0:4])
+		value = uint64(binary.LittleEndian.Uint32(data[0:4]))
+	case 0xff:
+		_, err = io.ReadFull(in, data[0:8])
+		value = binary.LittleEndian.Uint64(data[0:8])
+	default:
+		value = uint64(prefix)
+	}
+	return value, err
+}
+
+func bootstrap_read(f *os.File, ingest func(block BlockData) error) (checkpoint_header [80]byte, err error) {
+	//every block is passed to ingest (if given) as its read, the trailer is only checked at the end
+	var zip *gzip.Reader
+	if zip, err = gzip.NewReader(f); err != nil {
+		return checkpoint_header, fmt.Errorf("not a bootstrap file (%s)", err.Error())
+	}
+	defer zip.Close()
+	in := bufio.NewReader(zip)
+
+	var header [127]byte
+	if _, err = io.ReadFull(in, header[0:11]); err != nil || string(header[0:9]) != BOOTSTRAP_MAGIC {
+		return checkpoint_header, fmt.Errorf("not a bootstrap file")
+	}
+	if version := binary.BigEndian.Uint16(header[9:11]); version != BOOTSTRAP_VERSION {
+		return checkpoint_header, fmt.Errorf("unsupported bootstrap version %d", version)
+	}
+	if _, err = io.ReadFull(in, header[11:127]); err != nil {
+		return checkpoint_header, fmt.Errorf("bootstrap file is truncated")
+	}
+	COMBInfo.Guard.RLock()
+	var same_network bool = binary.LittleEndian.Uint32(header[11:15]) == COMBInfo.Magic && string(header[15:47]) == string(COMBInfo.Checkpoint[:])
+	COMBInfo.Guard.RUnlock()
+	if !same_network {
+		return checkpoint_header, fmt.Errorf("bootstrap file is for a different network")
+	}
+	copy(checkpoint_header[:], header[47:127])
+
+	var fingerprint [32]byte
+	var total uint64
+	for {
+		var marker byte
+		if marker, err = in.ReadByte(); err != nil {
+			return checkpoint_header, fmt.Errorf("bootstrap file is truncated")
+		}
+		if marker == 'E' {
+			break
+		}
+		if marker != 'B' {
+			return checkpoint_header, fmt.Errorf("bootstrap file is corrupted")
+		}
+
+		var block BlockData
+		var stored [32]byte
+		var commits uint64
+		var fields [176]byte
+		if _, err = io.ReadFull(in, fields[:]); err != nil {
+			return checkpoint_header, fmt.Errorf("bootstrap file is truncated")
+		}
+		copy(block.Hash[:], fields[0:32])
+		copy(block.Previous[:], fields[32:64])
+		copy(block.Header[:], fields[64:144])
+		copy(stored[:], fields[144:176])
+		if commits, err = bootstrap_read_varint(in); err != nil || commits > BOOTSTRAP_MAX_COMMITS {
+			return checkpoint_header, fmt.Errorf("bootstrap file is corrupted")
+		}
+		block.Commits = make([][32]byte, commits)
+		for i := range block.Commits {
+			if _, err = io.ReadFull(in, block.Commits[i][:]); err != nil {
+				return checkpoint_header, fmt.Errorf("bootstrap file is truncated")
+			}
+		}
+
+		if block.Header == [80]byte{} {
+			return checkpoint_header, fmt.Errorf("block %X has no header", block.Hash)
+		}
+		if db_compute_block_fingerprint(block.Commits) != stored {
+			return checkpoint_header, fmt.Errorf("fingerprint mismatch on block %X", block.Hash)
+		}
+		fingerprint = xor_hex(fingerprint, stored)
+		total++
+
+		if ingest != nil {
+			if err = ingest(block); err != nil {
+				return checkpoint_header, err
+			}
+		}
+	}
+
+	var trailer [40]byte
+	if _, err = io.ReadFull(in, trailer[:]); err != nil {
+		return checkpoint_header, fmt.Errorf("bootstrap file is truncated")
+	}
+	if binary.BigEndian.Uint64(trailer[0:8]) != total || string(trailer[8:40]) != string(fingerprint[:]) {
+		return checkpoint_header, fmt.Errorf("bootstrap file does not match its fingerprint")
+	}
+	return checkpoint_header, nil
+}
+
+func bootstrap_import(path string) (count uint64, err error) {
+	//the file is read twice, first to check it against its trailer and then to ingest it, so a bad file changes nothing
+	//every block goes through ingest, so links and headers are all checked again
+	//commits are only checked against the fingerprints in the file, bitcoin isnt asked
+	var f *os.File
+	var checkpoint_header [80]byte
+	if f, err = os.Open(path); err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if !IngestInfo.Guard.TryLock() {
+		return 0, fmt.Errorf("blocks are being ingested already (mining or a push), try again later")
+	}
+	defer IngestInfo.Guard.Unlock()
+	defer ingest_write()
+
+	if checkpoint_header, err = bootstrap_read(f, nil); err != nil {
+		return 0, err
+	}
+	//checked against the checkpoint hash, so a bad one is refused
+	if err = combcore_set_checkpoint_header(checkpoint_header); err != nil {
+		return 0, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	_, err = bootstrap_read(f, func(block BlockData) (err error) {
+		COMBInfo.Guard.RLock()
+		_, known := COMBInfo.Chain[block.Hash]
+		COMBInfo.Guard.RUnlock()
+		if known {
+			return nil
+		}
+		if err = ingest_process_block(block); err != nil {
+			return err
+		}
+		count++
+		if count%10000 == 0 {
+			log_status("bootstrap", "imported %d blocks", count)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	log_status("bootstrap", "imported %d new blocks from %s", count, path)
+	return count, nil
+}
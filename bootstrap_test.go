@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"libcomb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func test_strip_header(t testing.TB, height uint64) {
+	//make a block look like it was stored before headers were kept
+	metadata := db_get_block_metadata_by_height(height)
+	metadata.Header = [80]byte{}
+	batch := new(StorageBatch)
+	db_store_header(batch, metadata)
+	if err := db_write(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBootstrapRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap.gz")
+	test_setup(t)
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	count, fingerprint, err := bootstrap_export(path)
+	if err != nil || count != 10 {
+		t.Fatal(count, err)
+	}
+
+	test_setup(t)
+	if count, err = bootstrap_import(path); err != nil || count != 10 {
+		t.Fatal(count, err)
+	}
+	ingest_write()
+	if COMBInfo.Hash != chain[9].Hash || db_compute_db_fingerprint() != fingerprint {
+		t.Fatalf("imported to %X", COMBInfo.Hash)
+	}
+}
+
+func TestBootstrapCheckpointHeader(t *testing.T) {
+	//the file carries the checkpoint header for nodes that dont have it built in
+	path := filepath.Join(t.TempDir(), "bootstrap.gz")
+	test_setup(t)
+	header := COMBInfo.CheckpointHeader
+	test_ingest(t, test_chain(t, COMBInfo.Hash, 3, 0))
+	if _, _, err := bootstrap_export(path); err != nil {
+		t.Fatal(err)
+	}
+
+	test_setup(t)
+	test_forget_checkpoint_header()
+	if count, err := bootstrap_import(path); err != nil || count != 3 {
+		t.Fatal(count, err)
+	}
+	if COMBInfo.CheckpointHeader != header {
+		t.Fatal("checkpoint header was not taken from the file")
+	}
+
+	//and nothing is exported without it
+	test_setup(t)
+	test_forget_checkpoint_header()
+	if _, _, err := bootstrap_export(path + ".2"); err == nil {
+		t.Fatal("exported without the checkpoint header")
+	}
+}
+
+func test_tamper_bootstrap(t testing.TB, path string, tampered string, change func(data []byte) []byte) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zip, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(zip)
+	var buffer bytes.Buffer
+	out := gzip.NewWriter(&buffer)
+	out.Write(change(data))
+	out.Close()
+	if err = ioutil.WriteFile(tampered, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBootstrapTrailer(t *testing.T) {
+	//a file that doesnt match its trailer imports nothing at all, not even the blocks before the problem
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.gz")
+	test_setup(t)
+	test_ingest(t, test_chain(t, COMBInfo.Hash, 10, 0))
+	if _, _, err := bootstrap_export(good); err != nil {
+		t.Fatal(err)
+	}
+
+	test_tamper_bootstrap(t, good, filepath.Join(dir, "truncated.gz"), func(data []byte) []byte {
+		return data[:len(data)-41]
+	})
+	test_tamper_bootstrap(t, good, filepath.Join(dir, "count.gz"), func(data []byte) []byte {
+		data[len(data)-33]++
+		return data
+	})
+	test_tamper_bootstrap(t, good, filepath.Join(dir, "fingerprint.gz"), func(data []byte) []byte {
+		data[len(data)-1] ^= 1
+		return data
+	})
+	for _, name := range []string{"truncated.gz", "count.gz", "fingerprint.gz"} {
+		test_setup(t)
+		var start uint64 = COMBInfo.Height
+		if _, err := bootstrap_import(filepath.Join(dir, name)); err == nil {
+			t.Fatalf("imported %s", name)
+		}
+		if report := db_check(); COMBInfo.Height != start || report.Blocks != 0 {
+			t.Fatalf("%s left %d blocks behind", name, report.Blocks)
+		}
+	}
+
+	//nothing else can ingest during an import
+	test_setup(t)
+	IngestInfo.Guard.Lock()
+	_, err := bootstrap_import(good)
+	IngestInfo.Guard.Unlock()
+	if err == nil {
+		t.Fatal("imported while something else was ingesting")
+	}
+	if _, err = bootstrap_import(good); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBootstrapNoHeaders(t *testing.T) {
+	dir := t.TempDir()
+	test_setup(t)
+	var start uint64 = COMBInfo.Height
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	//good file to tamper with later
+	if _, _, err := bootstrap_export(filepath.Join(dir, "good.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	test_strip_header(t, start+4)
+	if _, _, err := bootstrap_export(filepath.Join(dir, "bad.gz")); err == nil {
+		t.Fatal("exported a block without a header")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.gz")); err == nil {
+		t.Fatal("failed export left a file behind")
+	}
+
+	//zero the header of the first block (after the 127 byte file header, the marker, hash and previous)
+	test_tamper_bootstrap(t, filepath.Join(dir, "good.gz"), filepath.Join(dir, "tampered.gz"), func(data []byte) []byte {
+		copy(data[127+1+64:127+1+64+80], make([]byte, 80))
+		return data
+	})
+
+	test_setup(t)
+	if _, err := bootstrap_import(filepath.Join(dir, "tampered.gz")); err == nil {
+		t.Fatal("imported a block without a header")
+	}
+	if COMBInfo.Height != start {
+		t.Fatalf("import moved the tip to %d", COMBInfo.Height)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	//exporting a damaged db fails without repairing it, the repair is left to check-db or the node
+	_, chain, start := test_leveldb_setup(t)
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	db_start()
+	test_ingest(t, chain)
+	file := filepath.Join(t.TempDir(), "bootstrap.gz")
+	db_close()
+	if err := combcore_command([]string{"export", file}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	tag := encode_tag(libcomb.Tag{Height: start + 5, Order: 0})
+	batch := new(StorageBatch)
+	batch.Delete(tag[:])
+	if err := db_write(batch); err != nil {
+		t.Fatal(err)
+	}
+	db_close()
+	if err := combcore_command([]string{"export", file}); err == nil {
+		t.Fatal("exported a damaged db")
+	}
+
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	if report := db_check(); report.LastHeight != start+10 || report.LastGoodHeight != start+4 {
+		t.Fatalf("db was changed (%v)", report)
+	}
+	if _, err := db_get_meta(DB_META_REPAIR); err == nil {
+		t.Fatal("export started a repair")
+	}
+}
@@ -1,64 +1,154 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"net/http"
+	"strings"
 	"sync"
-	"time"
 )
 
 type BlockData struct {
 	Hash     [32]byte
 	Previous [32]byte
+	Header   [80]byte
 	Commits  [][32]byte
 }
 
+type BlockResult struct {
+	Block BlockData
+	Err   error
+}
+
 type ChainInfo struct {
 	Height      uint64
 	KnownHeight uint64
 	TopHash     [32]byte
+	Network     string //bitcoin cores name for the network, empty if the source cant tell us
 }
 
 var BTCInfo struct {
-	RestClient *http.Client
-	RestURL    string
-	DirectPath string
-	Chain      ChainInfo
-	Enabled    bool
-	Guard      sync.RWMutex
+	Sources  []BlockSource //peers in order of preference
+	Source   int           //the source we are currently mining from
+	Verified []bool        //sources that passed btc_check_network
+	Mismatch string        //why we refuse to mine, empty if we dont
+	Direct   *DirectSource //nil if direct mining is disabled
+	Chain    ChainInfo
+	Enabled  bool
+	Guard    sync.RWMutex
+
+	//newest blocks held back from ingest until they have enough confirmations
+	Pending       []BlockData
+	PendingHeight uint64 //height of the first pending block
 }
 
 func btc_init() {
-	BTCInfo.Enabled = *btc_peer != ""
+	//btc_peer and btc_p2p are comma separated lists, if a peer goes down we fail over to the next one
+	for _, peer := range strings.Split(*btc_peer, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			BTCInfo.Sources = append(BTCInfo.Sources, rest_new_source(peer))
+		}
+	}
+	for _, peer := range strings.Split(*btc_p2p, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		source, err := p2p_new_source(peer)
+		if err != nil {
+			log_error("btc", "ignoring p2p peer %s (%s)", peer, err.Error())
+			continue
+		}
+		BTCInfo.Sources = append(BTCInfo.Sources, source)
+	}
+
+	BTCInfo.Enabled = len(BTCInfo.Sources) != 0
 	if !BTCInfo.Enabled {
 		log_status("btc", "mining disabled (no peer configured)")
 		return
 	}
+	for _, source := range BTCInfo.Sources {
+		log_status("btc", "mining from %s", source.Name())
+	}
 
-	BTCInfo.RestURL = fmt.Sprintf("http://%s:%d/rest", *btc_peer, *btc_port)
-	BTCInfo.RestClient = &http.Client{}
-	BTCInfo.RestClient.Timeout = time.Second
+	BTCInfo.Verified = make([]bool, len(BTCInfo.Sources))
 
-	if err := direct_check_path(*btc_data); err != nil {
+	if key, err := direct_check_path(*btc_data); err != nil {
 		log_status("btc", "direct mining disabled (%s)", err.Error())
+		if BTCInfo.Mismatch != "" {
+			log_error("btc", "mining disabled (%s)", BTCInfo.Mismatch)
+			BTCInfo.Enabled = false
+		}
 	} else {
-		BTCInfo.DirectPath = *btc_data
+		BTCInfo.Direct = &DirectSource{Path: *btc_data, Key: key}
 	}
 }
 
 func btc_get_chains() (err error) {
+	//no lock is held while talking to the sources, the results go into BTCInfo at the end
+	//(btc_check_network takes COMBInfo.Guard, which GetStatus holds while waiting on BTCInfo.Guard)
+	BTCInfo.Guard.RLock()
+	var sources []BlockSource = append([]BlockSource{}, BTCInfo.Sources...)
+	var verified []bool = append([]bool{}, BTCInfo.Verified...)
+	var first int = BTCInfo.Source
+	BTCInfo.Guard.RUnlock()
+
+	//start with the source we used last, moving down the list until one answers
+	var chain ChainInfo
+	var chosen int = -1
+	var mismatch string
+	var disagree error
+	for i := 0; i < len(sources); i++ {
+		var current int = (first + i) % len(sources)
+		var source BlockSource = sources[current]
+		if chain, err = source.GetChain(); err != nil {
+			log_error("btc", "%s is unavailable (%s)", source.Name(), err.Error())
+			verified[current] = false //might not be the same node when it comes back
+			continue
+		}
+		if !verified[current] {
+			var network_mismatch error
+			if network_mismatch, err = btc_check_network(source, chain); err != nil {
+				log_error("btc", "cannot check the network of %s (%s)", source.Name(), err.Error())
+				continue
+			}
+			if network_mismatch != nil {
+				log_error("btc", "refusing to mine from %s (%s)", source.Name(), network_mismatch.Error())
+				mismatch = network_mismatch.Error()
+				continue
+			}
+			verified[current] = true
+		}
+		chosen = current
+		if *btc_cross_check {
+			disagree = btc_check_sources(sources, current, chain)
+		}
+		break
+	}
+
 	BTCInfo.Guard.Lock()
 	defer BTCInfo.Guard.Unlock()
+	copy(BTCInfo.Verified, verified)
 
-	var chain ChainInfo
-	if chain, err = rest_get_chains(BTCInfo.RestClient, BTCInfo.RestURL); err != nil {
+	if chosen == -1 {
+		if mismatch != "" {
+			BTCInfo.Mismatch = mismatch
+		}
 		BTCInfo.Chain.KnownHeight = 0 //signals we are disconnected
-		return err
+		if BTCInfo.Mismatch != "" {
+			return fmt.Errorf("network mismatch (%s)", BTCInfo.Mismatch)
+		}
+		return fmt.Errorf("no source is available")
 	}
-	BTCInfo.Chain = chain
 
+	BTCInfo.Mismatch = ""
+	if chosen != BTCInfo.Source {
+		log_status("btc", "failing over to %s", sources[chosen].Name())
+		BTCInfo.Source = chosen
+	}
+	if disagree != nil {
+		BTCInfo.Chain.KnownHeight = 0
+		return fmt.Errorf("sources disagree (%s)", disagree.Error())
+	}
+	BTCInfo.Chain = chain
 	return nil
 }
 
@@ -69,13 +159,39 @@ func btc_sync() {
 		return //cant connect to peer
 	}
 
+	//new blocks are checked against their parents header, so the ones we have must have theirs first
+	if err := btc_get_checkpoint_header(); err != nil {
+		log_error("btc", "cannot get the checkpoint header (%s)", err.Error())
+		return
+	}
+	for DBInfo.MissingHeaders != 0 {
+		var missing uint64 = DBInfo.MissingHeaders
+		btc_fill_headers()
+		if DBInfo.MissingHeaders == missing {
+			break //no progress, ingest refuses whatever needs them
+		}
+	}
+
 	if COMBInfo.Hash == BTCInfo.Chain.TopHash {
+		btc_set_pending(nil)
 		return //nothing to do
 	}
 
+	BTCInfo.Guard.RLock()
+	var pending_top bool = len(BTCInfo.Pending) != 0 && BTCInfo.Pending[len(BTCInfo.Pending)-1].Hash == BTCInfo.Chain.TopHash
+	BTCInfo.Guard.RUnlock()
+	if pending_top {
+		return //only the held back blocks are left
+	}
+
 	//get block delta for displaying mining progress to the user
 	var delta int64 = int64(BTCInfo.Chain.Height) - int64(COMBInfo.Height)
 
+	if !IngestInfo.Guard.TryLock() {
+		return //a push or an import is running, we sync after it
+	}
+	defer IngestInfo.Guard.Unlock()
+
 	log_status("btc", "%d blocks behind...", delta)
 
 	var blocks chan BlockData = make(chan BlockData)
@@ -84,11 +200,27 @@ func btc_sync() {
 
 	//spin up a goroutine to ingest blocks
 	go func() {
+		var rejected bool
+		var held []BlockData
 		for block := range blocks {
-			ingest_process_block(block)
+			if rejected {
+				continue //drain the rest, nothing after a rejected block can connect
+			}
+			//hold back the newest blocks, only ingesting once enough have arrived after them
+			held = btc_hold_block(held, block)
+			if uint(len(held)) <= *btc_min_confirmations {
+				continue
+			}
+			block, held = held[0], held[1:]
+			if err := ingest_process_block(block); err != nil {
+				log_error("btc", "block rejected (%s)", err.Error())
+				rejected = true
+				held = nil
+			}
 		}
 		//block channel closed, now flush the cache
 		ingest_write()
+		btc_set_pending(held)
 		wait.Unlock()
 	}()
 
@@ -96,102 +228,476 @@ func btc_sync() {
 	if err := btc_get_block_range(target, uint64(delta), blocks); err != nil {
 		log_error("btc", "failed to get blocks (%s)", err.Error())
 	}
+	close(blocks)
 	wait.Lock() //dont leave before neominer is finished (only a problem if we use a buffered channel)
 }
 
+func btc_hold_block(held []BlockData, block BlockData) []BlockData {
+	//when direct mining fails the peer sends again from the last ingested block, those replace the held ones so none are held twice
+	COMBInfo.Guard.RLock()
+	_, known := COMBInfo.Chain[block.Hash]
+	var top [32]byte = COMBInfo.Hash
+	COMBInfo.Guard.RUnlock()
+	if known {
+		return held //ingested already
+	}
+	for i := range held {
+		if held[i].Hash == block.Previous {
+			return append(held[:i+1], block)
+		}
+	}
+	if block.Previous == top {
+		return append(held[:0], block)
+	}
+	return append(held, block) //doesnt connect, ingest rejects it
+}
+
+func btc_set_pending(blocks []BlockData) {
+	COMBInfo.Guard.RLock()
+	var height uint64 = COMBInfo.Height + 1
+	COMBInfo.Guard.RUnlock()
+
+	BTCInfo.Guard.Lock()
+	BTCInfo.Pending = blocks
+	BTCInfo.PendingHeight = height
+	BTCInfo.Guard.Unlock()
+
+	if len(blocks) != 0 {
+		log_status("btc", "%d blocks pending", len(blocks))
+	}
+}
+
 func btc_get_block_range(target [32]byte, delta uint64, blocks chan<- BlockData) (err error) {
-	if BTCInfo.DirectPath != "" && delta > 10 { //use direct mining if its available and delta is big enough (>10)
-		if err = direct_get_block_range(BTCInfo.DirectPath, target, delta, blocks); err != nil {
-			return err
+	if BTCInfo.Direct != nil && delta > 10 { //use direct mining if its available and delta is big enough (>10)
+		if err = BTCInfo.Direct.GetBlockRange(target, delta, blocks); err == nil {
+			return nil
 		}
-	} else {
-		if err = rest_get_block_range(BTCInfo.RestClient, BTCInfo.RestURL, target, delta, blocks); err != nil {
-			return err
+		//whatever direct mining couldnt get we get from our peer, its traced from the last ingested block
+		log_error("btc", "direct mining stopped, continuing from peer (%s)", err.Error())
+	}
+
+	BTCInfo.Guard.Lock()
+	var source BlockSource = BTCInfo.Sources[BTCInfo.Source]
+	BTCInfo.Guard.Unlock()
+
+	if err = source.GetBlockRange(target, delta, blocks); err != nil {
+		//move on so the next sync starts with a different source, the target came from this one
+		BTCInfo.Guard.Lock()
+		BTCInfo.Source = (BTCInfo.Source + 1) % len(BTCInfo.Sources)
+		BTCInfo.Guard.Unlock()
+		return fmt.Errorf("%s failed (%s)", source.Name(), err.Error())
+	}
+	return nil
+}
+
+// most headers filled in one go, the rest wait for the next sync
+const BTC_FILL_HEADERS_LIMIT = 20000
+
+func btc_fill_headers() {
+	//blocks stored before headers were kept get them from our peer, the stored hash proves the header is the right one
+	if DBInfo.MissingHeaders == 0 {
+		return
+	}
+
+	BTCInfo.Guard.RLock()
+	var source BlockSource = BTCInfo.Sources[BTCInfo.Source]
+	var mismatch bool = BTCInfo.Mismatch != ""
+	BTCInfo.Guard.RUnlock()
+	if mismatch {
+		return //the source isnt one we trust for anything
+	}
+
+	var batch *StorageBatch = new(StorageBatch)
+	var height uint64 = DBInfo.MissingFrom
+	var filled uint64
+	var missing uint64 = DBInfo.MissingHeaders
+
+	for filled < BTC_FILL_HEADERS_LIMIT {
+		var metadata BlockMetadata = db_get_block_metadata_by_height(height)
+		if metadata.Height != height {
+			missing = 0 //went past the top, anything still counted was reorged out
+			break
+		}
+		if metadata.Header != [80]byte{} {
+			height++
+			continue
+		}
+
+		headers, found, err := source.GetHeaders(metadata.Previous, BTC_MAX_HEADERS)
+		if err != nil {
+			log_error("btc", "cannot fill headers from %s (%s)", source.Name(), err.Error())
+			break
+		}
+		if !found || len(headers) == 0 {
+			log_error("btc", "cannot fill headers, block %d is not on the best chain of %s", height, source.Name())
+			break
+		}
+
+		var start uint64 = height
+		for _, header := range headers {
+			hash, _ := btc_parse_header(header)
+			if metadata = db_get_block_metadata_by_height(height); metadata.Hash != hash {
+				break //our chain ends or goes a different way here
+			}
+			if metadata.Header == [80]byte{} {
+				metadata.Header = header
+				db_store_header(batch, metadata)
+				missing--
+				filled++
+			}
+			height++
+		}
+		if height == start {
+			log_error("btc", "cannot fill headers, block %d is not on the best chain of %s", height, source.Name())
+			break
+		}
+		if missing == 0 {
+			break
+		}
+	}
+
+	if batch.Len() != 0 {
+		if err := db_write(batch); err != nil {
+			log_error("btc", "cannot store headers (%s)", err.Error())
+			return
+		}
+	}
+	DBInfo.MissingHeaders = missing
+	DBInfo.MissingFrom = height
+	if filled == 0 {
+		return
+	}
+
+	//the top block may have been one of them
+	COMBInfo.Guard.Lock()
+	if COMBInfo.Header == [80]byte{} {
+		COMBInfo.Header = db_get_block_metadata_by_hash(COMBInfo.Hash).Header
+	}
+	COMBInfo.Guard.Unlock()
+
+	log_status("btc", "filled %d headers, %d missing", filled, missing)
+}
+
+func btc_get_checkpoint_header() (err error) {
+	//only needed while nothing is on top of the checkpoint, networks with it built in never get here
+	COMBInfo.Guard.RLock()
+	var needed bool = COMBInfo.CheckpointHeader == [80]byte{} && COMBInfo.Hash == COMBInfo.Checkpoint
+	var checkpoint [32]byte = COMBInfo.Checkpoint
+	COMBInfo.Guard.RUnlock()
+	if !needed {
+		return nil
+	}
+
+	var raw []byte
+	var header [80]byte
+	if raw, err = btc_get_raw_block(checkpoint); err != nil {
+		return err
+	}
+	copy(header[:], raw[0:80])
+	return combcore_set_checkpoint_header(header)
+}
+
+func btc_get_raw_block(hash [32]byte) (data []byte, err error) {
+	//the block files first, then every peer starting with the one we are mining from
+	BTCInfo.Guard.RLock()
+	var sources []BlockSource
+	if BTCInfo.Direct != nil {
+		sources = append(sources, BTCInfo.Direct)
+	}
+	for i := range BTCInfo.Sources {
+		sources = append(sources, BTCInfo.Sources[(BTCInfo.Source+i)%len(BTCInfo.Sources)])
+	}
+	BTCInfo.Guard.RUnlock()
+
+	for _, source := range sources {
+		if data, err = source.GetRawBlock(hash); err == nil {
+			return data, nil
 		}
+		log_error("btc", "%s cannot provide block %X (%s)", source.Name(), hash, err.Error())
+	}
+	return nil, fmt.Errorf("no source has block %X", hash)
+}
+
+func btc_fetch_ordered(length int, workers int, fetch func(i int) (BlockData, error), out chan<- BlockData) (err error) {
+	//fetch blocks 0 to length-1 with a pool of workers, blocks are still delivered in order
+	//fetch gets the position so callers keep their own list of what to fetch, nothing is copied here
+	type job struct {
+		position int
+		result   chan BlockResult
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var jobs chan job = make(chan job)
+	var order chan chan BlockResult = make(chan chan BlockResult, workers*2) //limits how far ahead we prefetch
+	var stop chan struct{} = make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(jobs)
+		defer close(order)
+		for i := 0; i < length; i++ {
+			j := job{i, make(chan BlockResult, 1)}
+			select {
+			case order <- j.result:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for j := range jobs {
+				block, err := fetch(j.position)
+				j.result <- BlockResult{block, err}
+			}
+		}()
+	}
+
+	var count int
+	for result := range order {
+		r := <-result
+		if r.Err != nil {
+			return r.Err
+		}
+		out <- r.Block
+		count++
+
+		var progress float64 = (float64(count) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
 	}
 	return nil
 }
-func btc_parse_varint(data []byte) (value uint64, advance uint8) {
+
+func btc_parse_varint(data []byte) (value uint64, advance uint8, err error) {
 	//parse a BTC varint. see https://learnmeabitcoin.com/technical/varint
 
+	if len(data) < 1 {
+		return 0, 0, fmt.Errorf("varint truncated")
+	}
+
 	prefix := data[0]
 
 	switch prefix {
 	case 0xfd:
-		value = uint64(binary.LittleEndian.Uint16(data[1:]))
 		advance = 3
 	case 0xfe:
-		value = uint64(binary.LittleEndian.Uint32(data[1:]))
 		advance = 5
 	case 0xff:
-		value = uint64(binary.LittleEndian.Uint64(data[1:]))
 		advance = 9
 	default:
-		value = uint64(prefix)
-		advance = 1
+		return uint64(prefix), 1, nil
+	}
+
+	if len(data) < int(advance) {
+		return 0, 0, fmt.Errorf("varint truncated")
+	}
+
+	switch prefix {
+	case 0xfd:
+		value = uint64(binary.LittleEndian.Uint16(data[1:]))
+	case 0xfe:
+		value = uint64(binary.LittleEndian.Uint32(data[1:]))
+	case 0xff:
+		value = uint64(binary.LittleEndian.Uint64(data[1:]))
 	}
 
-	return value, advance
+	return value, advance, nil
 }
 
-func btc_parse_block(data []byte, block *BlockData) {
-	//parse a raw BTC block. see https://learnmeabitcoin.com/technical/blkdat
+func btc_read(data *[]byte, size uint64) (out []byte, err error) {
+	//take size bytes off the front of data, failing instead of running off the end
+	if uint64(len(*data)) < size {
+		return nil, fmt.Errorf("data truncated (need %d bytes, have %d)", size, len(*data))
+	}
+	out = (*data)[:size]
+	*data = (*data)[size:]
+	return out, nil
+}
 
-	var current_commit [32]byte
-	block.Hash = sha256.Sum256(data[0:80])
-	block.Hash = sha256.Sum256(block.Hash[:])
-	data = data[4:] //version(4)
-	copy(block.Previous[:], data[0:32])
-	data = data[32:] //previous(32)
-	data = data[44:] //merkle root(32),time(4),bits(4),nonce(4)
+func btc_read_varint(data *[]byte) (value uint64, err error) {
+	var adv uint8
+	if value, adv, err = btc_parse_varint(*data); err != nil {
+		return 0, err
+	}
+	*data = (*data)[adv:]
+	return value, nil
+}
+
+func btc_encode_varint(value uint64) []byte {
+	//encode a BTC varint, the inverse of btc_parse_varint
+	var data [9]byte
+	switch {
+	case value < 0xfd:
+		return []byte{byte(value)}
+	case value <= 0xffff:
+		data[0] = 0xfd
+		binary.LittleEndian.PutUint16(data[1:], uint16(value))
+		return data[:3]
+	case value <= 0xffffffff:
+		data[0] = 0xfe
+		binary.LittleEndian.PutUint32(data[1:], uint32(value))
+		return data[:5]
+	default:
+		data[0] = 0xff
+		binary.LittleEndian.PutUint64(data[1:], value)
+		return data[:9]
+	}
+}
 
-	tx_count, adv := btc_parse_varint(data[:])
-	data = data[adv:] //tx count(var)
+func btc_parse_header(header [80]byte) (hash [32]byte, previous [32]byte) {
+	//hash a raw BTC header and get its parent, both in haircomb byte order
+	hash = btc_double_sha256(header[:])
+	copy(previous[:], header[4:36])
+	return swap_endian(hash), swap_endian(previous)
+}
 
+func btc_parse_tx(data *[]byte) (txid [32]byte, commits [][32]byte, err error) {
+	//parse one raw transaction off the front of data, returning its txid and P2WSH outputs
+	var current_commit [32]byte
+	var field []byte
+	var in_count, out_count, size uint64
 	var segwit bool
-	for t := 0; t < int(tx_count); t++ {
-		segwit = false
-		data = data[4:] //version(4)
-		in_count, adv := btc_parse_varint(data[:])
-
-		if in_count == 0 { //segwit marker is 0x00
-			segwit = true
-			data = data[2:] //marker(1),flag(1)
-			in_count, adv = btc_parse_varint(data[:])
-		}
-
-		data = data[adv:] //vin count(var)
-		for i := 0; i < int(in_count); i++ {
-			data = data[36:] //txid(32), vout(4)
-			sig_size, adv := btc_parse_varint(data[:])
-			data = data[uint64(adv)+sig_size+4:] //sig size(var), sig(var),sequence(4)
-		}
-		out_count, adv := btc_parse_varint(data[:])
-		data = data[adv:] //vout count(var)
-		for i := 0; i < int(out_count); i++ {
-			data = data[8:] //value(8)
-			pub_size, adv := btc_parse_varint(data[:])
-			data = data[uint64(adv):] //pub size(var)
-			if pub_size == 34 && data[0] == 0 && data[1] == 32 {
-				copy(current_commit[:], data[2:34])
-				block.Commits = append(block.Commits, current_commit)
+	var tx, body []byte = *data, nil
+
+	if _, err = btc_read(data, 4); err != nil { //version(4)
+		return txid, nil, err
+	}
+	body = *data
+	if in_count, err = btc_read_varint(data); err != nil { //vin count(var)
+		return txid, nil, err
+	}
+
+	if in_count == 0 { //segwit marker is 0x00
+		segwit = true
+		if _, err = btc_read(data, 1); err != nil { //flag(1)
+			return txid, nil, err
+		}
+		body = *data
+		if in_count, err = btc_read_varint(data); err != nil { //vin count(var)
+			return txid, nil, err
+		}
+	}
+
+	for i := uint64(0); i < in_count; i++ {
+		if _, err = btc_read(data, 36); err != nil { //txid(32), vout(4)
+			return txid, nil, err
+		}
+		if size, err = btc_read_varint(data); err != nil { //sig size(var)
+			return txid, nil, err
+		}
+		if _, err = btc_read(data, size+4); err != nil { //sig(var),sequence(4)
+			return txid, nil, err
+		}
+	}
+
+	if out_count, err = btc_read_varint(data); err != nil { //vout count(var)
+		return txid, nil, err
+	}
+	for i := uint64(0); i < out_count; i++ {
+		if _, err = btc_read(data, 8); err != nil { //value(8)
+			return txid, nil, err
+		}
+		if size, err = btc_read_varint(data); err != nil { //pub size(var)
+			return txid, nil, err
+		}
+		if field, err = btc_read(data, size); err != nil { //pub (var)
+			return txid, nil, err
+		}
+		if size == 34 && field[0] == 0 && field[1] == 32 {
+			copy(current_commit[:], field[2:34])
+			commits = append(commits, current_commit)
+		}
+	}
+	body = body[:len(body)-len(*data)] //vin count up to the end of the outputs
+	if segwit {
+		for i := uint64(0); i < in_count; i++ {
+			var witness_count uint64
+			if witness_count, err = btc_read_varint(data); err != nil { //witness count(var)
+				return txid, nil, err
 			}
-			data = data[pub_size:] //pub (var)
-		}
-		if segwit {
-			for i := 0; i < int(in_count); i++ {
-				witness_count, adv := btc_parse_varint(data[:])
-				data = data[adv:] //witness count(var)
-				for w := 0; w < int(witness_count); w++ {
-					witness_size, adv := btc_parse_varint(data[:])
-					data = data[uint64(adv)+witness_size:] //witness size(var), witness(var)
+			for w := uint64(0); w < witness_count; w++ {
+				if size, err = btc_read_varint(data); err != nil { //witness size(var)
+					return txid, nil, err
+				}
+				if _, err = btc_read(data, size); err != nil { //witness(var)
+					return txid, nil, err
 				}
 			}
 		}
-		data = data[4:] //locktime(4)
+	}
+	if field, err = btc_read(data, 4); err != nil { //locktime(4)
+		return txid, nil, err
 	}
 
-	//we use big endian in haircomb, btc uses little endian for some values
-	block.Hash = swap_endian(block.Hash)
-	block.Previous = swap_endian(block.Previous)
+	//the txid leaves out the segwit marker, flag and witnesses
+	if segwit {
+		stripped := make([]byte, 0, 4+len(body)+4)
+		stripped = append(stripped, tx[0:4]...)
+		stripped = append(stripped, body...)
+		stripped = append(stripped, field...)
+		txid = btc_double_sha256(stripped)
+	} else {
+		txid = btc_double_sha256(tx[:len(tx)-len(*data)])
+	}
+	return txid, commits, nil
+}
+
+func btc_check_raw_block(data []byte, hash [32]byte) error {
+	//make sure a raw block is the one we asked for, the rest is checked when its parsed
+	var header [80]byte
+	if len(data) < 80 {
+		return fmt.Errorf("block %X is truncated", hash)
+	}
+	copy(header[:], data[0:80])
+	if found, _ := btc_parse_header(header); found != hash {
+		return fmt.Errorf("recieved wrong block %X != %X", found, hash)
+	}
+	return nil
+}
+
+func btc_parse_block(data []byte, block *BlockData) (err error) {
+	//parse a raw BTC block. see https://learnmeabitcoin.com/technical/blkdat
+	//malformed data returns an error, nothing here trusts the sizes in the block
+	//txids are computed as we go so the commits can be checked against the headers merkle root
+
+	var field []byte
+	var txids [][32]byte
+
+	if field, err = btc_read(&data, 80); err != nil { //version(4),previous(32),merkle root(32),time(4),bits(4),nonce(4)
+		return fmt.Errorf("bad header (%s)", err.Error())
+	}
+	copy(block.Header[:], field)
+	block.Hash, block.Previous = btc_parse_header(block.Header)
+
+	var tx_count uint64
+	if tx_count, err = btc_read_varint(&data); err != nil { //tx count(var)
+		return err
+	}
+
+	for t := uint64(0); t < tx_count; t++ {
+		txid, commits, err := btc_parse_tx(&data)
+		if err != nil {
+			return err
+		}
+		txids = append(txids, txid)
+		block.Commits = append(block.Commits, commits...)
+	}
+
+	if len(data) != 0 {
+		return fmt.Errorf("%d bytes of trailing data", len(data))
+	}
+
+	if err = btc_check_merkle_root(block.Header, txids); err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -1,149 +1,746 @@
 package main
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
-type RawData map[[32]byte]*BlockData
+// block status flags from bitcoin cores block index (see chain.h)
+const DIRECT_BLOCK_HAVE_DATA = 8
+const DIRECT_BLOCK_HAVE_UNDO = 16
 
-func direct_parse_block_file(data []byte, blocks *RawData, path string) {
-	f, err := os.Open(path)
-	if err != nil {
-		log_error("direct", "cant open file %s (%s)", path, err.Error())
-		return
+type BlockLocation struct {
+	Hash     [32]byte
+	Previous [32]byte
+	Height   uint64
+	Status   uint64
+	File     uint64
+	Position uint64
+}
+
+// where the last direct sync started in the block files, so the next one only has to scan what came after
+type DirectCursor struct {
+	File     uint64
+	Position uint64   //start of the block data, like BlockLocation
+	Hash     [32]byte //block found there, if it changed the files were rewritten (reindex, prune)
+}
+
+// never scan more block files than this from the cursor, the index is faster by then
+const DIRECT_SCAN_LIMIT = 4
+
+// largest a serialized block can be
+const DIRECT_MAX_BLOCK_MB = 4
+
+type DirectReader struct {
+	Path   string
+	Key    []byte
+	File   *os.File
+	Number uint64
+	Buffer []byte
+}
+
+type DirectSource struct {
+	Path string
+	Key  []byte
+}
+
+func (source *DirectSource) Name() string {
+	return "direct " + source.Path
+}
+
+func (source *DirectSource) GetChain() (ChainInfo, error) {
+	return ChainInfo{}, fmt.Errorf("direct mining cannot see the best chain")
+}
+
+func (source *DirectSource) GetHeaders(start [32]byte, count int) ([][80]byte, bool, error) {
+	return nil, false, fmt.Errorf("direct mining cannot see the best chain")
+}
+
+func (source *DirectSource) GetBlock(hash [32]byte) (BlockData, error) {
+	return direct_get_block(source.Path, source.Key, hash)
+}
+
+func (source *DirectSource) GetRawBlock(hash [32]byte) ([]byte, error) {
+	return direct_get_raw_block(source.Path, source.Key, hash)
+}
+
+func (source *DirectSource) GetBlockRange(target [32]byte, length uint64, out chan<- BlockData) error {
+	return direct_get_block_range(source.Path, source.Key, target, length, out)
+}
+
+func direct_parse_varint(data []byte) (value uint64, advance int, err error) {
+	//bitcoin cores internal varint (MSB base 128 with an offset), not the same as btc_parse_varint. see serialize.h
+	for advance < len(data) {
+		if advance >= 10 {
+			return 0, 0, fmt.Errorf("varint too long")
+		}
+		b := data[advance]
+		advance++
+		value = (value << 7) | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return value, advance, nil
+		}
+		value++
 	}
-	stats, _ := f.Stat()
-	data = data[:stats.Size()]
-	buf := bufio.NewReader(f)
-	buf.Read(data)
-	f.Close()
+	return 0, 0, fmt.Errorf("varint truncated")
+}
 
-	var p int = 0
-	var size int
+func direct_parse_location(hash [32]byte, data []byte) (location BlockLocation, err error) {
+	//parse a CDiskBlockIndex record. see chain.h
+	var fields [4]uint64 //client version, height, status, tx count
+	var adv int
 
-	for {
+	location.Hash = hash
 
-		//check for the end of file, otherwise check if the magic bytes are there
-		if p >= len(data) || binary.LittleEndian.Uint32(data[p:p+4]) != COMBInfo.Magic {
-			break
+	for i := range fields {
+		if fields[i], adv, err = direct_parse_varint(data); err != nil {
+			return location, err
+		}
+		data = data[adv:]
+	}
+	location.Height = fields[1]
+	location.Status = fields[2]
+
+	if location.Status&(DIRECT_BLOCK_HAVE_DATA|DIRECT_BLOCK_HAVE_UNDO) != 0 {
+		if location.File, adv, err = direct_parse_varint(data); err != nil {
+			return location, err
+		}
+		data = data[adv:]
+	}
+	if location.Status&DIRECT_BLOCK_HAVE_DATA != 0 {
+		if location.Position, adv, err = direct_parse_varint(data); err != nil {
+			return location, err
+		}
+		data = data[adv:]
+	}
+	if location.Status&DIRECT_BLOCK_HAVE_UNDO != 0 {
+		if _, adv, err = direct_parse_varint(data); err != nil {
+			return location, err
+		}
+		data = data[adv:]
+	}
+
+	if len(data) < 80 {
+		return location, fmt.Errorf("block index record too short")
+	}
+	copy(location.Previous[:], data[4:36]) //version(4), previous(32)
+	location.Previous = swap_endian(location.Previous)
+
+	return location, nil
+}
+
+// the block index copy, kept between syncs so only what bitcoin core changed is copied again
+var DirectIndexCopy struct {
+	Warned bool
+	Guard  sync.Mutex //one copy in use at a time
+}
+
+// attempts at a copy that didnt change while it was taken
+const DIRECT_COPY_ATTEMPTS = 3
+
+func direct_open_index(path string) (index *leveldb.DB, cleanup func(), err error) {
+	var options opt.Options
+	options.ReadOnly = true
+	options.ErrorIfMissing = true
+
+	path = path + "/blocks/index"
+	cleanup = func() {}
+
+	//bitcoin core keeps the index open while running, a read only open works on most systems
+	if index, err = leveldb.OpenFile(path, &options); err == nil {
+		return index, cleanup, nil
+	}
+
+	//otherwise read a copy of the index, kept next to our db
+	DirectIndexCopy.Guard.Lock()
+	var copy_path string = COMBInfo.Path + ".index"
+	if !DirectIndexCopy.Warned {
+		log_error("direct", "cannot open block index directly (%s), reading a copy in %s instead. stop bitcoind while mining to avoid copying it", err.Error(), copy_path)
+		DirectIndexCopy.Warned = true
+	}
+
+	for attempt := 1; ; attempt++ {
+		var copied int
+		if copied, err = direct_refresh_copy(path, copy_path); err == nil {
+			log_info("direct", "copied %d block index files", copied)
+			if index, err = leveldb.OpenFile(copy_path, &options); err == nil {
+				return index, DirectIndexCopy.Guard.Unlock, nil
+			}
+		}
+		if attempt == DIRECT_COPY_ATTEMPTS {
+			//start from nothing next time, the copy may be what is broken
+			os.RemoveAll(copy_path)
+			DirectIndexCopy.Guard.Unlock()
+			return nil, cleanup, fmt.Errorf("cannot copy block index (%s)", err.Error())
+		}
+		log_error("direct", "block index copy is not usable, copying again (%s)", err.Error())
+	}
+}
+
+func direct_stat_dir(path string) (files map[string]os.FileInfo, err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(path); err != nil {
+		return nil, err
+	}
+	files = make(map[string]os.FileInfo, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == "LOCK" {
+			continue
+		}
+		if files[entry.Name()], err = entry.Info(); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func direct_same_file(a os.FileInfo, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+func direct_refresh_copy(src string, dst string) (copied int, err error) {
+	//bring dst up to date with the leveldb in src. tables are never rewritten, so a table thats already there is kept.
+	//the log, manifest and CURRENT change in place and are always copied. if src changes while copying its an error, the copy could be torn
+	var before, after, existing map[string]os.FileInfo
+	if before, err = direct_stat_dir(src); err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return 0, err
+	}
+	if existing, err = direct_stat_dir(dst); err != nil {
+		return 0, err
+	}
+	for name := range existing {
+		if _, ok := before[name]; !ok {
+			if err = os.Remove(filepath.Join(dst, name)); err != nil {
+				return copied, err
+			}
+		}
+	}
+	for name, info := range before {
+		var table bool = filepath.Ext(name) == ".ldb" || filepath.Ext(name) == ".sst"
+		if have, ok := existing[name]; ok && table && have.Size() == info.Size() {
+			continue
 		}
-		p += 4
-		//next 4 bytes is the size of the upcoming block
-		size = int(binary.LittleEndian.Uint32(data[p : p+4]))
-		p += 4
+		if err = direct_copy_file(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+
+	if after, err = direct_stat_dir(src); err != nil {
+		return copied, err
+	}
+	if len(after) != len(before) {
+		return copied, fmt.Errorf("block index changed while copying")
+	}
+	for name, info := range before {
+		if changed, ok := after[name]; !ok || !direct_same_file(info, changed) {
+			return copied, fmt.Errorf("block index changed while copying (%s)", name)
+		}
+	}
+	return copied, nil
+}
+
+func direct_copy_file(src string, dst string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return err
+	}
+	defer in.Close()
+	if out, err = os.Create(dst); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func direct_get_location(index *leveldb.DB, hash [32]byte) (location BlockLocation, err error) {
+	//index keys are 'b' followed by the hash in bitcoins byte order
+	var key [33]byte
+	var value []byte
+	var raw [32]byte = swap_endian(hash)
+	key[0] = 'b'
+	copy(key[1:], raw[:])
 
-		//now actually parse the block
-		block := new(BlockData)
-		btc_parse_block(data[p:p+size], block)
-		(*blocks)[block.Hash] = block
-		p += size
+	if value, err = index.Get(key[:], nil); err != nil {
+		return location, fmt.Errorf("block %X not in block index (%s)", hash, err.Error())
 	}
+	return direct_parse_location(hash, value)
 }
 
-func direct_trace_chain(blocks *RawData, target [32]byte, length uint64) (block_chain [][32]byte) {
+func direct_trace_chain(index *leveldb.DB, target [32]byte, length uint64) (chain []BlockLocation, err error) {
 	//trace back from target to a known block (any block in COMBInfo.Chain)
+	//only the locations are kept, so memory stays small no matter how far behind we are
 	var hash [32]byte = target
+	var location BlockLocation
 
-	//lock the chain while we trace it
-	COMBInfo.Guard.RLock()
-	defer COMBInfo.Guard.RUnlock()
 	for {
-		if block, ok := (*blocks)[hash]; ok {
-			block_chain = append(block_chain, hash)
-			hash = block.Previous
-			if _, ok := COMBInfo.Chain[hash]; ok {
-				break
-			}
-		} else {
+		COMBInfo.Guard.RLock()
+		_, ok := COMBInfo.Chain[hash]
+		COMBInfo.Guard.RUnlock()
+		if ok {
 			break
 		}
-	}
 
-	var progress float64 = (float64(len(block_chain)) / float64(length)) * 100.0
-	combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
+		if location, err = direct_get_location(index, hash); err != nil {
+			return nil, err
+		}
+		chain = append(chain, location) //pruned blocks stay in the chain, they get fetched from a peer
+		hash = location.Previous
 
-	//check if we actually found a known block
-	if _, ok := COMBInfo.Chain[hash]; !ok {
-		return nil //nope
+		if len(chain)%1000 == 0 {
+			var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
+			combcore_set_status(fmt.Sprintf("Tracing (%.2f%%)...", progress))
+		}
 	}
 
 	//reverse chain so we mine old blocks first
-	for i, j := 0, len(block_chain)-1; i < j; i, j = i+1, j-1 {
-		block_chain[i], block_chain[j] = block_chain[j], block_chain[i]
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
 	}
 
-	return block_chain
+	return chain, nil
 }
 
-func direct_load_trace(blocks *RawData, path string, target [32]byte, length uint64) (chain [][32]byte, err error) {
-	var block_data []byte = make([]byte, 128*1024*1024) //blk files are max 128mb
-	var block_files []string
-	if block_files, err = filepath.Glob(path + "/blocks/blk*.dat"); err != nil {
+func direct_read_raw_block(reader *DirectReader, location BlockLocation) (raw_data []byte, err error) {
+	//the returned data is the readers buffer, its overwritten by the next read
+	if reader.File == nil || reader.Number != location.File {
+		if reader.File != nil {
+			reader.File.Close()
+			reader.File = nil
+		}
+		if reader.File, err = os.Open(fmt.Sprintf("%s/blocks/blk%05d.dat", reader.Path, location.File)); err != nil {
+			return nil, err
+		}
+		reader.Number = location.File
+	}
+
+	//the index points at the block data, the magic and size come just before it
+	if location.Position < 8 {
+		return nil, fmt.Errorf("invalid block position %d", location.Position)
+	}
+	var prefix [8]byte
+	if _, err = reader.File.ReadAt(prefix[:], int64(location.Position-8)); err != nil {
+		return nil, err
+	}
+	direct_xor(reader.Key, prefix[:], location.Position-8)
+	if binary.LittleEndian.Uint32(prefix[0:4]) != COMBInfo.Magic {
+		return nil, fmt.Errorf("bad magic for block %X in blk%05d.dat", location.Hash, location.File)
+	}
+	var size int = int(binary.LittleEndian.Uint32(prefix[4:8]))
+	if size > DIRECT_MAX_BLOCK_MB<<20 {
+		//a corrupt size would have us allocate up to 4GB
+		return nil, fmt.Errorf("record for block %X in blk%05d.dat is %d bytes, too large for a block", location.Hash, location.File, size)
+	}
+
+	if cap(reader.Buffer) < size {
+		reader.Buffer = make([]byte, size)
+	}
+	reader.Buffer = reader.Buffer[:size]
+	if _, err = reader.File.ReadAt(reader.Buffer, int64(location.Position)); err != nil {
 		return nil, err
 	}
+	direct_xor(reader.Key, reader.Buffer, location.Position)
+	return reader.Buffer, nil
+}
 
-	//reverse block files, so we trace backwards from new blocks (saves time)
-	for i, j := 0, len(block_files)-1; i < j; i, j = i+1, j-1 {
-		block_files[i], block_files[j] = block_files[j], block_files[i]
+func direct_read_block(reader *DirectReader, location BlockLocation, block *BlockData) (err error) {
+	var raw_data []byte
+	if raw_data, err = direct_read_raw_block(reader, location); err != nil {
+		return err
 	}
 
-	for b := range block_files {
+	if err = btc_parse_block(raw_data, block); err != nil {
+		return fmt.Errorf("bad record for block %X in blk%05d.dat (%s)", location.Hash, location.File, err.Error())
+	}
 
-		//read & process the block file and load it into blocks
-		//we preallocate and pass in a 128mb buffer to read the block file into (block_data)
-		direct_parse_block_file(block_data, blocks, block_files[b])
+	if block.Hash != location.Hash {
+		return fmt.Errorf("block file has %X, expected %X", block.Hash, location.Hash)
+	}
+	return nil
+}
 
-		log_status("direct", "processed %s", block_files[b])
+func direct_close_reader(reader *DirectReader) {
+	if reader.File != nil {
+		reader.File.Close()
+		reader.File = nil
+	}
+}
 
-		//now see if we have a valid chain loaded (from target to any block in history)
-		chain = direct_trace_chain(blocks, target, length)
+func direct_xor(key []byte, data []byte, offset uint64) {
+	//undo bitcoin cores block file obfuscation, the key is applied based on the position in the file
+	if len(key) == 0 {
+		return
+	}
+	for i := range data {
+		data[i] ^= key[(offset+uint64(i))%uint64(len(key))]
+	}
+}
 
-		if len(chain) != 0 {
-			log_status("direct", "chain connected. finished")
-			break //valid chain found
+func direct_read_key(path string) (key []byte, err error) {
+	//newer versions of bitcoin core obfuscate the block files with a key in xor.dat
+	if key, err = os.ReadFile(path + "/blocks/xor.dat"); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil //older version, no obfuscation
 		}
+		return nil, err
 	}
-	return chain, nil
+	if len(key) != 8 {
+		return nil, fmt.Errorf("xor.dat is %d bytes, expected 8", len(key))
+	}
+	for _, b := range key {
+		if b != 0 {
+			return key, nil
+		}
+	}
+	return nil, nil //all zero key means no obfuscation
 }
 
-func direct_check_path(path string) (err error) {
+func direct_check_path(path string) (key []byte, err error) {
 	if path == "" {
-		return fmt.Errorf("no path configured")
+		return nil, fmt.Errorf("no path configured")
 	}
-	path = path + "/blocks"
-	if _, err = os.Stat(path); err != nil {
-		return err
+	if _, err = os.Stat(path + "/blocks/index"); err != nil {
+		return nil, err
 	}
 	var block_files []string
-	if block_files, err = filepath.Glob(path + "/blk*.dat"); err != nil {
-		return err
+	if block_files, err = filepath.Glob(path + "/blocks/blk*.dat"); err != nil {
+		return nil, err
 	}
 	if len(block_files) == 0 {
-		return fmt.Errorf("no block files found")
+		return nil, fmt.Errorf("no block files found")
+	}
+
+	if key, err = direct_read_key(path); err != nil {
+		return nil, fmt.Errorf("cannot read obfuscation key (%s)", err.Error())
+	}
+
+	//the oldest block file always starts with a block, make sure we can understand it
+	var f *os.File
+	var magic [4]byte
+	if f, err = os.Open(block_files[0]); err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(f, magic[:])
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s (%s)", filepath.Base(block_files[0]), err.Error())
+	}
+	direct_xor(key, magic[:], 0)
+	if binary.LittleEndian.Uint32(magic[:]) != COMBInfo.Magic {
+		if network := btc_network_by_magic(binary.LittleEndian.Uint32(magic[:])); network != "" {
+			BTCInfo.Mismatch = fmt.Sprintf("block files in %s are for %s, we are on %s", path, network, COMBInfo.Network)
+			return nil, fmt.Errorf("%s", BTCInfo.Mismatch)
+		}
+		if key != nil {
+			return nil, fmt.Errorf("block files not understood after de-obfuscating (found magic %X)", magic)
+		}
+		return nil, fmt.Errorf("block files not understood (found magic %X)", magic)
 	}
 
+	if key != nil {
+		log_status("direct", "block files are obfuscated (key %X)", key)
+	}
 	log_status("direct", "found %d block files", len(block_files))
-	return nil
+	return key, nil
+}
+
+func direct_find_block(path string, hash [32]byte) (location BlockLocation, err error) {
+	var index *leveldb.DB
+	var cleanup func()
+
+	if index, cleanup, err = direct_open_index(path); err != nil {
+		return location, err
+	}
+	location, err = direct_get_location(index, hash)
+	index.Close()
+	cleanup()
+	if err != nil {
+		return location, err
+	}
+	if location.Status&DIRECT_BLOCK_HAVE_DATA == 0 {
+		return location, fmt.Errorf("block %X is not on disk", hash)
+	}
+	return location, nil
+}
+
+func direct_get_block(path string, key []byte, hash [32]byte) (block BlockData, err error) {
+	var location BlockLocation
+	if location, err = direct_find_block(path, hash); err != nil {
+		return block, err
+	}
+
+	var reader DirectReader
+	reader.Path = path
+	reader.Key = key
+	defer direct_close_reader(&reader)
+
+	err = direct_read_block(&reader, location, &block)
+	return block, err
+}
+
+func direct_get_raw_block(path string, key []byte, hash [32]byte) (raw_data []byte, err error) {
+	var location BlockLocation
+	if location, err = direct_find_block(path, hash); err != nil {
+		return nil, err
+	}
+
+	var reader DirectReader
+	reader.Path = path
+	reader.Key = key
+	defer direct_close_reader(&reader)
+
+	if raw_data, err = direct_read_raw_block(&reader, location); err != nil {
+		return nil, err
+	}
+	if err = btc_check_raw_block(raw_data, hash); err != nil {
+		return nil, err
+	}
+	return raw_data, nil
+}
+
+func direct_get_cursor() (cursor DirectCursor, err error) {
+	var data []byte
+	if data, err = db_get_meta(DB_META_DIRECT_CURSOR); err != nil {
+		return cursor, err
+	}
+	if len(data) != 48 {
+		return cursor, fmt.Errorf("cursor is gibberish")
+	}
+	cursor.File = binary.BigEndian.Uint64(data[0:8])
+	cursor.Position = binary.BigEndian.Uint64(data[8:16])
+	copy(cursor.Hash[:], data[16:48])
+	return cursor, nil
+}
+
+func direct_set_cursor(cursor DirectCursor) (err error) {
+	var data [48]byte
+	binary.BigEndian.PutUint64(data[0:8], cursor.File)
+	binary.BigEndian.PutUint64(data[8:16], cursor.Position)
+	copy(data[16:48], cursor.Hash[:])
+
+	batch := new(StorageBatch)
+	db_put_meta(batch, DB_META_DIRECT_CURSOR, data[:])
+	return db_write(batch)
+}
+
+func direct_scan(path string, key []byte, cursor DirectCursor) (locations map[[32]byte]BlockLocation, err error) {
+	//read just the headers of every block record from the cursor onwards
+	//blocks are appended as they arrive, so new blocks are almost always after the cursor
+	var f *os.File
+	var record [88]byte //magic(4), size(4), header(80)
+
+	locations = make(map[[32]byte]BlockLocation)
+
+	for number := cursor.File; number < cursor.File+DIRECT_SCAN_LIMIT; number++ {
+		if f, err = os.Open(fmt.Sprintf("%s/blocks/blk%05d.dat", path, number)); err != nil {
+			if number == cursor.File {
+				return nil, err //pruned away
+			}
+			return locations, nil //no newer files
+		}
+
+		var offset uint64 = 0
+		if number == cursor.File {
+			offset = cursor.Position - 8
+		}
+		for {
+			if _, err = f.ReadAt(record[:], int64(offset)); err != nil {
+				break //end of the file
+			}
+			direct_xor(key, record[:], offset)
+			if binary.LittleEndian.Uint32(record[0:4]) != COMBInfo.Magic {
+				break //files are preallocated with zeros past the last record
+			}
+
+			var location BlockLocation
+			var header [80]byte
+			copy(header[:], record[8:88])
+			location.Hash, location.Previous = btc_parse_header(header)
+			location.Status = DIRECT_BLOCK_HAVE_DATA
+			location.File = number
+			location.Position = offset + 8
+
+			if number == cursor.File && offset == cursor.Position-8 && location.Hash != cursor.Hash {
+				f.Close()
+				return nil, fmt.Errorf("block files changed since the last sync")
+			}
+			locations[location.Hash] = location
+			offset += 8 + uint64(binary.LittleEndian.Uint32(record[4:8]))
+		}
+		f.Close()
+
+		if number == cursor.File && len(locations) == 0 {
+			return nil, fmt.Errorf("block files changed since the last sync")
+		}
+	}
+	return locations, nil
+}
+
+func direct_trace_scanned(locations map[[32]byte]BlockLocation, target [32]byte) (chain []BlockLocation, err error) {
+	//same as direct_trace_chain but only using blocks found by direct_scan
+	var hash [32]byte = target
+	for {
+		COMBInfo.Guard.RLock()
+		_, ok := COMBInfo.Chain[hash]
+		COMBInfo.Guard.RUnlock()
+		if ok {
+			break
+		}
+
+		location, ok := locations[hash]
+		if !ok {
+			return nil, fmt.Errorf("block %X is before the cursor", hash)
+		}
+		chain = append(chain, location)
+		hash = location.Previous
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+func direct_trace_incremental(path string, key []byte, target [32]byte) (chain []BlockLocation, err error) {
+	var cursor DirectCursor
+	var locations map[[32]byte]BlockLocation
+	if cursor, err = direct_get_cursor(); err != nil {
+		return nil, fmt.Errorf("no cursor")
+	}
+	if cursor.Position < 8 {
+		return nil, fmt.Errorf("cursor is gibberish")
+	}
+	if locations, err = direct_scan(path, key, cursor); err != nil {
+		return nil, err
+	}
+	return direct_trace_scanned(locations, target)
+}
+
+func direct_report_pruned(chain []BlockLocation) {
+	//log each run of blocks that bitcoin core has pruned away
+	var first, last uint64
+	var count int
+	for i, location := range chain {
+		if location.Status&DIRECT_BLOCK_HAVE_DATA == 0 {
+			if count == 0 {
+				first = location.Height
+			}
+			last = location.Height
+			count++
+		}
+		if count != 0 && (i == len(chain)-1 || chain[i+1].Status&DIRECT_BLOCK_HAVE_DATA != 0) {
+			log_status("direct", "blocks %d to %d are pruned, getting them from peer", first, last)
+			count = 0
+		}
+	}
+}
+
+func direct_get_pruned_block(hash [32]byte) (block BlockData, err error) {
+	//try every peer, starting with the one we are mining from
+	BTCInfo.Guard.RLock()
+	var sources []BlockSource = BTCInfo.Sources
+	var current int = BTCInfo.Source
+	BTCInfo.Guard.RUnlock()
+
+	for i := range sources {
+		source := sources[(current+i)%len(sources)]
+		if block, err = source.GetBlock(hash); err == nil {
+			return block, nil
+		}
+		log_error("direct", "%s cannot provide pruned block %X (%s)", source.Name(), hash, err.Error())
+	}
+	return block, fmt.Errorf("block %X is pruned and no peer has it, it cannot be recovered", hash)
+}
+
+func direct_workers() (workers int) {
+	//every worker keeps a buffer as big as the largest block it has read (up to 4MB), btc_direct_memory caps the total
+	workers = int(*btc_direct_workers)
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	if limit := int(*btc_direct_memory / DIRECT_MAX_BLOCK_MB); workers > limit {
+		workers = limit
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
 }
-func direct_get_block_range(path string, target [32]byte, length uint64, out chan<- BlockData) (err error) {
-	defer close(out)
-	var blocks RawData = make(RawData)
-	var chain [][32]byte
 
-	//read the raw block data, tracing the blocks back from the target to a known block (probably a checkpoint)
-	//processed blocks are stored IN MEMORY until a complete/valid chain is found (expect ~1gb of RAM usage)
-	if chain, err = direct_load_trace(&blocks, path, target, length); err != nil {
+func direct_get_block_range(path string, key []byte, target [32]byte, length uint64, out chan<- BlockData) (err error) {
+	var index *leveldb.DB
+	var cleanup func()
+	var chain []BlockLocation
+
+	//try scanning from where we were last time, opening the index can mean copying it
+	if chain, err = direct_trace_incremental(path, key, target); err != nil {
+		log_info("direct", "scanning from the block index (%s)", err.Error())
+
+		//the block index tells us where every block is, so nothing but the current block is held in memory
+		if index, cleanup, err = direct_open_index(path); err != nil {
+			return err
+		}
+		chain, err = direct_trace_chain(index, target, length)
+		index.Close()
+		cleanup()
+		if err != nil {
+			return err
+		}
+	}
+
+	log_status("direct", "chain connected. %d blocks to mine", len(chain))
+
+	//each worker reads and parses with its own reader, blocks still come out in chain order
+	var workers int = direct_workers()
+	var readers chan *DirectReader = make(chan *DirectReader, workers)
+	for i := 0; i < workers; i++ {
+		readers <- &DirectReader{Path: path, Key: key}
+	}
+	defer func() {
+		for i := 0; i < workers; i++ {
+			direct_close_reader(<-readers)
+		}
+	}()
+
+	direct_report_pruned(chain)
+
+	//workers go straight to the chain for locations, the delta isnt copied anywhere else
+	fetch := func(i int) (block BlockData, err error) {
+		if chain[i].Status&DIRECT_BLOCK_HAVE_DATA == 0 {
+			return direct_get_pruned_block(chain[i].Hash)
+		}
+		reader := <-readers
+		err = direct_read_block(reader, chain[i], &block)
+		readers <- reader
+		return block, err
+	}
+	if err = btc_fetch_ordered(len(chain), workers, fetch, out); err != nil {
 		return err
 	}
 
-	//now that we have a known valid chain we can feed the blocks to neominer
-	combcore_set_status("Storing...")
-	for _, hash := range chain {
-		out <- *blocks[hash]
+	//next time start scanning from the first block of this sync, later blocks may still be pending
+	for _, location := range chain {
+		if location.Status&DIRECT_BLOCK_HAVE_DATA == 0 {
+			continue
+		}
+		if err = direct_set_cursor(DirectCursor{location.File, location.Position, location.Hash}); err != nil {
+			log_error("direct", "cannot save cursor (%s)", err.Error())
+		}
+		break
 	}
 	return nil
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var TEST_XOR_KEY = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+
+func test_blk_file(t testing.TB, path string, number int, key []byte, magic uint32, blocks ...[]byte) (locations []BlockLocation) {
+	//a block file like bitcoin core writes them, records of magic, size and block, obfuscated with key
+	var data bytes.Buffer
+	for _, raw := range blocks {
+		binary.Write(&data, binary.LittleEndian, magic)
+		binary.Write(&data, binary.LittleEndian, uint32(len(raw)))
+		var location BlockLocation
+		var header [80]byte
+		copy(header[:], raw[0:80])
+		location.Hash, location.Previous = btc_parse_header(header)
+		location.Status = DIRECT_BLOCK_HAVE_DATA
+		location.File = uint64(number)
+		location.Position = uint64(data.Len())
+		locations = append(locations, location)
+		data.Write(raw)
+	}
+	data.Write(make([]byte, 64)) //preallocated space after the last record
+
+	raw := data.Bytes()
+	direct_xor(key, raw, 0)
+	if err := os.MkdirAll(filepath.Join(path, "blocks", "index"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		if err := os.WriteFile(filepath.Join(path, "blocks", "xor.dat"), key, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(path, "blocks", fmt.Sprintf("blk%05d.dat", number)), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return locations
+}
+
+func TestDirectXor(t *testing.T) {
+	data := []byte("some block data that is longer than the key")
+	original := append([]byte{}, data...)
+
+	//the key lines up with the position in the file, not the start of the data
+	direct_xor(TEST_XOR_KEY, data, 13)
+	for i := range data {
+		if data[i] != original[i]^TEST_XOR_KEY[(13+i)%8] {
+			t.Fatalf("byte %d obfuscated with the wrong part of the key", i)
+		}
+	}
+	direct_xor(TEST_XOR_KEY, data[:5], 13)
+	direct_xor(TEST_XOR_KEY, data[5:], 18)
+	if !bytes.Equal(data, original) {
+		t.Fatal("xor in two parts did not undo the xor")
+	}
+
+	direct_xor(nil, data, 0)
+	if !bytes.Equal(data, original) {
+		t.Fatal("no key changed the data")
+	}
+}
+
+func TestDirectReadKey(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "blocks"), 0755)
+	xor := filepath.Join(dir, "blocks", "xor.dat")
+
+	if key, err := direct_read_key(dir); key != nil || err != nil {
+		t.Fatalf("missing xor.dat gave %X (%v)", key, err)
+	}
+	os.WriteFile(xor, make([]byte, 8), 0644)
+	if key, err := direct_read_key(dir); key != nil || err != nil {
+		t.Fatalf("all zero xor.dat gave %X (%v)", key, err)
+	}
+	os.WriteFile(xor, TEST_XOR_KEY[:7], 0644)
+	if _, err := direct_read_key(dir); err == nil {
+		t.Fatal("7 byte xor.dat was accepted")
+	}
+	os.WriteFile(xor, append(TEST_XOR_KEY, 0), 0644)
+	if _, err := direct_read_key(dir); err == nil {
+		t.Fatal("9 byte xor.dat was accepted")
+	}
+	os.WriteFile(xor, TEST_XOR_KEY, 0644)
+	if key, err := direct_read_key(dir); !bytes.Equal(key, TEST_XOR_KEY) || err != nil {
+		t.Fatalf("xor.dat gave %X (%v)", key, err)
+	}
+}
+
+func TestDirectCheckPath(t *testing.T) {
+	test_setup(t)
+	t.Cleanup(func() { BTCInfo.Mismatch = "" })
+	block := test_raw_block(COMBInfo.Hash, test_raw_tx(1, nil))
+
+	if _, err := direct_check_path(t.TempDir()); err == nil {
+		t.Fatal("directory without a block index was accepted")
+	}
+	empty := t.TempDir()
+	os.MkdirAll(filepath.Join(empty, "blocks", "index"), 0755)
+	if _, err := direct_check_path(empty); err == nil {
+		t.Fatal("directory without block files was accepted")
+	}
+
+	plain := t.TempDir()
+	test_blk_file(t, plain, 0, nil, COMBInfo.Magic, block)
+	if key, err := direct_check_path(plain); key != nil || err != nil {
+		t.Fatalf("plain block files gave %X (%v)", key, err)
+	}
+
+	obfuscated := t.TempDir()
+	test_blk_file(t, obfuscated, 0, TEST_XOR_KEY, COMBInfo.Magic, block)
+	if key, err := direct_check_path(obfuscated); !bytes.Equal(key, TEST_XOR_KEY) || err != nil {
+		t.Fatalf("obfuscated block files gave %X (%v)", key, err)
+	}
+
+	//the key doesnt match the files
+	os.WriteFile(filepath.Join(obfuscated, "blocks", "xor.dat"), []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0644)
+	if _, err := direct_check_path(obfuscated); err == nil {
+		t.Fatal("block files with the wrong key were accepted")
+	}
+
+	mainnet := t.TempDir()
+	test_blk_file(t, mainnet, 0, TEST_XOR_KEY, BTC_NETWORKS["mainnet"].Magic, block)
+	if _, err := direct_check_path(mainnet); err == nil || BTCInfo.Mismatch == "" {
+		t.Fatal("block files from another network were accepted")
+	}
+}
+
+func TestDirectReadBlock(t *testing.T) {
+	test_setup(t)
+	dir := t.TempDir()
+	var raw [][]byte
+	var previous [32]byte = COMBInfo.Hash
+	for i := 0; i < 3; i++ {
+		raw = append(raw, test_raw_block(previous, test_raw_tx(uint32(i), [][32]byte{test_commit(i)})))
+		hash, _ := btc_parse_header(*(*[80]byte)(raw[i][0:80]))
+		previous = hash
+	}
+	locations := test_blk_file(t, dir, 0, TEST_XOR_KEY, COMBInfo.Magic, raw...)
+
+	reader := &DirectReader{Path: dir, Key: TEST_XOR_KEY}
+	defer direct_close_reader(reader)
+	for i := len(locations) - 1; i >= 0; i-- {
+		var block BlockData
+		if err := direct_read_block(reader, locations[i], &block); err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash != locations[i].Hash || len(block.Commits) != 1 || block.Commits[0] != test_commit(i) {
+			t.Fatalf("read %X", block.Hash)
+		}
+	}
+
+	//a location that doesnt point at a record
+	bad := locations[1]
+	bad.Position += 8
+	if err := direct_read_block(reader, bad, &BlockData{}); err == nil {
+		t.Fatal("read a block from the wrong position")
+	}
+	bad = locations[1]
+	bad.Hash = locations[2].Hash
+	if err := direct_read_block(reader, bad, &BlockData{}); err == nil {
+		t.Fatal("read the wrong block")
+	}
+
+	//a record size no block can have is refused before anything is allocated
+	file := filepath.Join(dir, "blocks", "blk00000.dat")
+	data, _ := os.ReadFile(file)
+	direct_xor(TEST_XOR_KEY, data, 0)
+	binary.LittleEndian.PutUint32(data[locations[0].Position-4:], 0xFFFFFFFF)
+	direct_xor(TEST_XOR_KEY, data, 0)
+	os.WriteFile(file, data, 0644)
+	direct_close_reader(reader)
+	if _, err := direct_read_raw_block(reader, locations[0]); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("read an oversized record (%v)", err)
+	}
+
+	//scanning from a cursor finds the blocks after it
+	found, err := direct_scan(dir, TEST_XOR_KEY, DirectCursor{0, locations[1].Position, locations[1].Hash})
+	if err != nil || len(found) != 2 || found[locations[2].Hash] != locations[2] {
+		t.Fatalf("scan found %v (%v)", found, err)
+	}
+	if _, err = direct_scan(dir, TEST_XOR_KEY, DirectCursor{0, locations[1].Position, locations[0].Hash}); err == nil {
+		t.Fatal("scan did not notice the files changed")
+	}
+}
+
+func TestDirectGetBlockRange(t *testing.T) {
+	//blocks after the cursor come out in chain order however many workers read them
+	test_setup(t)
+	dir := t.TempDir()
+	var raw [][]byte
+	var previous [32]byte = COMBInfo.Hash
+	for i := 0; i < 20; i++ {
+		raw = append(raw, test_raw_block(previous, test_raw_tx(uint32(i), [][32]byte{test_commit(i)})))
+		hash, _ := btc_parse_header(*(*[80]byte)(raw[i][0:80]))
+		previous = hash
+	}
+	locations := test_blk_file(t, dir, 0, TEST_XOR_KEY, COMBInfo.Magic, raw...)
+	if err := direct_set_cursor(DirectCursor{0, locations[0].Position, locations[0].Hash}); err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("btc_direct_workers", "4")
+	t.Cleanup(func() { flag.Set("btc_direct_workers", "0") })
+
+	out := make(chan BlockData)
+	done := make(chan error)
+	go func() {
+		err := direct_get_block_range(dir, TEST_XOR_KEY, locations[19].Hash, 20, out)
+		close(out)
+		done <- err
+	}()
+	var i int
+	for block := range out {
+		if block.Hash != locations[i].Hash || len(block.Commits) != 1 || block.Commits[0] != test_commit(i) {
+			t.Fatalf("block %d is %X", i, block.Hash)
+		}
+		i++
+	}
+	if err := <-done; err != nil || i != 20 {
+		t.Fatalf("got %d blocks (%v)", i, err)
+	}
+}
+
+func test_fill_index(t testing.TB, index *leveldb.DB, from int, count int) {
+	//enough data to spill into table files
+	for i := from; i < from+count; i++ {
+		if err := index.Put([]byte(fmt.Sprintf("key%06d", i)), bytes.Repeat([]byte{byte(i)}, 1024), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func test_check_index(t testing.TB, path string, count int) {
+	index, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := 0; i < count; i++ {
+		if value, err := index.Get([]byte(fmt.Sprintf("key%06d", i)), nil); err != nil || len(value) != 1024 {
+			t.Fatalf("key %d is missing from the copy (%v)", i, err)
+		}
+	}
+}
+
+func TestDirectRefreshCopy(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "index")
+	index, err := leveldb.OpenFile(src, &opt.Options{WriteBuffer: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_fill_index(t, index, 0, 1000)
+	index.Close()
+
+	first, err := direct_refresh_copy(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_check_index(t, dst, 1000)
+
+	//nothing changed, only the files that change in place are copied again
+	again, err := direct_refresh_copy(src, dst)
+	if err != nil || again >= first {
+		t.Fatalf("copied %d of %d files again (%v)", again, first, err)
+	}
+
+	//after a compaction the old tables are gone from the copy too
+	if index, err = leveldb.OpenFile(src, &opt.Options{WriteBuffer: 64 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	test_fill_index(t, index, 1000, 1000)
+	index.CompactRange(util.Range{})
+	index.Close()
+	if _, err = direct_refresh_copy(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	test_check_index(t, dst, 2000)
+	have, _ := direct_stat_dir(dst)
+	want, _ := direct_stat_dir(src)
+	for name := range have {
+		if _, ok := want[name]; !ok {
+			t.Fatalf("%s was left in the copy", name)
+		}
+	}
+}
+
+func TestDirectOpenIndexLocked(t *testing.T) {
+	//bitcoin core holding the index open, we read a copy next to our db
+	test_setup(t)
+	dir := t.TempDir()
+	COMBInfo.Path = filepath.Join(t.TempDir(), "commits")
+	running, err := leveldb.OpenFile(filepath.Join(dir, "blocks", "index"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+	test_fill_index(t, running, 0, 10)
+
+	for i := 0; i < 2; i++ {
+		index, cleanup, err := direct_open_index(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := index.Get([]byte("key000009"), nil); err != nil || len(value) != 1024 {
+			t.Fatal("copy is missing a key", err)
+		}
+		index.Close()
+		cleanup()
+	}
+	if _, err = os.Stat(COMBInfo.Path + ".index"); err != nil {
+		t.Fatal("index was not copied", err)
+	}
+}
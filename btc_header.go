@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+const BTC_RETARGET_INTERVAL = 2016
+
+func btc_double_sha256(data []byte) [32]byte {
+	hash := sha256.Sum256(data)
+	return sha256.Sum256(hash[:])
+}
+
+func btc_compute_merkle_root(txids [][32]byte) (root [32]byte, mutated bool) {
+	//txids and root are in bitcoins byte order. see https://learnmeabitcoin.com/technical/merkle-root
+	//mutated means the tree has duplicate siblings, which would let the same root hide repeated transactions
+	if len(txids) == 0 {
+		return root, false
+	}
+	var level [][32]byte = append([][32]byte{}, txids...)
+	var pair [64]byte
+	for len(level) > 1 {
+		for i := 0; i+1 < len(level); i += 2 {
+			if level[i] == level[i+1] {
+				mutated = true
+			}
+		}
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			copy(pair[0:32], level[2*i][:])
+			copy(pair[32:64], level[2*i+1][:])
+			next[i] = btc_double_sha256(pair[:])
+		}
+		level = next
+	}
+	return level[0], mutated
+}
+
+func btc_check_merkle_root(header [80]byte, txids [][32]byte) error {
+	root, mutated := btc_compute_merkle_root(txids)
+	if mutated {
+		return fmt.Errorf("merkle tree is mutated")
+	}
+	if !bytes.Equal(root[:], header[36:68]) {
+		return fmt.Errorf("merkle root mismatch (%X != %X)", root, header[36:68])
+	}
+	return nil
+}
+
+func btc_header_bits(header [80]byte) uint32 {
+	return binary.LittleEndian.Uint32(header[72:76]) //version(4),previous(32),merkle root(32),time(4),bits(4)
+}
+
+func btc_compact_to_target(bits uint32) (target *big.Int, err error) {
+	//decode the compact target representation. see https://learnmeabitcoin.com/technical/bits
+	var exponent uint = uint(bits >> 24)
+	var mantissa int64 = int64(bits & 0x007fffff)
+
+	if bits&0x00800000 != 0 {
+		return nil, fmt.Errorf("negative target %08X", bits)
+	}
+
+	target = big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if target.Sign() == 0 {
+		return nil, fmt.Errorf("zero target %08X", bits)
+	}
+	return target, nil
+}
+
+func btc_check_pow(header [80]byte) (err error) {
+	//the header hash must be under its own target, and the target cant be easier than the network allows
+	var target *big.Int
+	if target, err = btc_compact_to_target(btc_header_bits(header)); err != nil {
+		return err
+	}
+
+	limit := new(big.Int).SetBytes(COMBInfo.PowLimit[:])
+	if target.Cmp(limit) > 0 {
+		return fmt.Errorf("target %08X is above the network limit", btc_header_bits(header))
+	}
+
+	hash, _ := btc_parse_header(header)
+	if new(big.Int).SetBytes(hash[:]).Cmp(target) > 0 {
+		return fmt.Errorf("hash %X does not meet target %08X", hash, btc_header_bits(header))
+	}
+	return nil
+}
+
+func btc_check_difficulty(header [80]byte, parent [80]byte, height uint64) (err error) {
+	//check the difficulty follows on from the parent, only possible on networks with normal retargeting
+	if !COMBInfo.PowRetarget {
+		return nil
+	}
+
+	bits := btc_header_bits(header)
+	parent_bits := btc_header_bits(parent)
+
+	if height%BTC_RETARGET_INTERVAL != 0 {
+		if bits != parent_bits {
+			return fmt.Errorf("difficulty changed outside of a retarget (%08X != %08X)", bits, parent_bits)
+		}
+		return nil
+	}
+
+	//retargets are clamped to a factor of 4 either way
+	var target, parent_target *big.Int
+	if target, err = btc_compact_to_target(bits); err != nil {
+		return err
+	}
+	if parent_target, err = btc_compact_to_target(parent_bits); err != nil {
+		return err
+	}
+
+	upper := new(big.Int).Lsh(parent_target, 2)
+	lower := new(big.Int).Rsh(parent_target, 2)
+	lower.Sub(lower, new(big.Int).Rsh(parent_target, 17)) //compact encoding rounds down a little
+	if target.Cmp(upper) > 0 || target.Cmp(lower) < 0 {
+		return fmt.Errorf("retarget out of range (%08X from %08X)", bits, parent_bits)
+	}
+	return nil
+}
+
+func btc_validate_header(header [80]byte, hash [32]byte, previous [32]byte, parent [80]byte, height uint64) (err error) {
+	//everything we can check about a block given its header and its parents header
+	//without the parent the difficulty could be anything under the network limit, so thats not enough
+	header_hash, header_previous := btc_parse_header(header)
+	if header_hash != hash || header_previous != previous {
+		return fmt.Errorf("header does not match block %X", hash)
+	}
+	if parent == [80]byte{} {
+		return fmt.Errorf("header of parent %X is not known", previous)
+	}
+	if parent_hash, _ := btc_parse_header(parent); parent_hash != previous {
+		return fmt.Errorf("parent header is for %X not %X", parent_hash, previous)
+	}
+	if err = btc_check_pow(header); err != nil {
+		return err
+	}
+	return btc_check_difficulty(header, parent, height)
+}
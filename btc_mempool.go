@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// new transactions fetched per poll, a big mempool fills in over a few polls
+const MEMPOOL_MAX_FETCH = 1000
+
+var MempoolInfo struct {
+	Enabled bool
+	Txs     map[[32]byte][][32]byte //txid -> commits, every transaction we have seen in the mempool
+	Commits map[[32]byte]uint64     //commit -> number of mempool transactions with it
+	Guard   sync.RWMutex
+}
+
+func mempool_init() {
+	//unconfirmed commits come from the mempool of a REST peer
+	MempoolInfo.Enabled = *btc_mempool && BTCInfo.Enabled
+	if !MempoolInfo.Enabled {
+		return
+	}
+	MempoolInfo.Txs = make(map[[32]byte][][32]byte)
+	MempoolInfo.Commits = make(map[[32]byte]uint64)
+	go mempool_watch()
+}
+
+func mempool_watch() {
+	for {
+		if err := mempool_sync(); err != nil {
+			log_error("mempool", "failed to sync (%s)", err.Error())
+		}
+		time.Sleep(time.Second * 10)
+	}
+}
+
+func mempool_get_source() (source *RESTSource) {
+	//prefer the source we are mining from, the mempool is only available over REST
+	BTCInfo.Guard.RLock()
+	defer BTCInfo.Guard.RUnlock()
+	for i := range BTCInfo.Sources {
+		if s, ok := BTCInfo.Sources[(BTCInfo.Source+i)%len(BTCInfo.Sources)].(*RESTSource); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func mempool_get_txids(source *RESTSource) (txids [][32]byte, err error) {
+	var raw_json json.RawMessage
+	var list []string
+	var verbose map[string]json.RawMessage
+
+	if raw_json, err = btc_rest_call(source.Client, fmt.Sprintf("%s/mempool/contents.json?verbose=false", source.URL)); err != nil {
+		return nil, err
+	}
+	//older versions ignore verbose=false and return an object keyed by txid
+	if err = json.Unmarshal(raw_json, &list); err != nil {
+		if err = json.Unmarshal(raw_json, &verbose); err != nil {
+			return nil, fmt.Errorf("mempool is gibberish (%s)", err.Error())
+		}
+		for txid := range verbose {
+			list = append(list, txid)
+		}
+	}
+
+	for _, l := range list {
+		var txid [32]byte
+		if txid, err = parse_hex(l); err != nil {
+			return nil, err
+		}
+		txids = append(txids, txid)
+	}
+	return txids, nil
+}
+
+func mempool_get_tx(source *RESTSource, txid [32]byte) (commits [][32]byte, err error) {
+	var raw_data []byte
+	var parsed [32]byte
+	if raw_data, err = btc_rest_call(source.Client, fmt.Sprintf("%s/tx/%x.bin", source.URL, txid)); err != nil {
+		return nil, err
+	}
+	if parsed, commits, err = btc_parse_tx(&raw_data); err != nil {
+		return nil, fmt.Errorf("tx %X is malformed (%s)", txid, err.Error())
+	}
+	if len(raw_data) != 0 {
+		return nil, fmt.Errorf("tx %X has trailing data", txid)
+	}
+	if swap_endian(parsed) != txid {
+		return nil, fmt.Errorf("recieved wrong tx %X != %X", swap_endian(parsed), txid)
+	}
+	return commits, nil
+}
+
+func mempool_sync() (err error) {
+	var source *RESTSource
+	var txids [][32]byte
+	if source = mempool_get_source(); source == nil {
+		return fmt.Errorf("no REST peer configured")
+	}
+	if txids, err = mempool_get_txids(source); err != nil {
+		return err
+	}
+
+	var current map[[32]byte]bool = make(map[[32]byte]bool, len(txids))
+	for _, txid := range txids {
+		current[txid] = true
+	}
+
+	//forget transactions that were mined or dropped
+	MempoolInfo.Guard.Lock()
+	for txid, commits := range MempoolInfo.Txs {
+		if !current[txid] {
+			mempool_remove_commits(commits)
+			delete(MempoolInfo.Txs, txid)
+		}
+	}
+	MempoolInfo.Guard.Unlock()
+
+	var fetched int
+	for _, txid := range txids {
+		MempoolInfo.Guard.RLock()
+		_, known := MempoolInfo.Txs[txid]
+		MempoolInfo.Guard.RUnlock()
+		if known {
+			continue
+		}
+		if fetched >= MEMPOOL_MAX_FETCH {
+			break
+		}
+		fetched++
+
+		commits, err := mempool_get_tx(source, txid)
+		if err != nil {
+			log_info("mempool", "skipping tx %X (%s)", txid, err.Error()) //probably mined in the meantime
+			continue
+		}
+
+		MempoolInfo.Guard.Lock()
+		MempoolInfo.Txs[txid] = commits
+		for _, commit := range commits {
+			MempoolInfo.Commits[commit]++
+		}
+		MempoolInfo.Guard.Unlock()
+	}
+
+	if fetched != 0 {
+		MempoolInfo.Guard.RLock()
+		log_info("mempool", "%d transactions, %d commits", len(MempoolInfo.Txs), len(MempoolInfo.Commits))
+		MempoolInfo.Guard.RUnlock()
+	}
+	return nil
+}
+
+func mempool_remove_commits(commits [][32]byte) {
+	//caller holds the guard
+	for _, commit := range commits {
+		if MempoolInfo.Commits[commit] <= 1 {
+			delete(MempoolInfo.Commits, commit)
+		} else {
+			MempoolInfo.Commits[commit]--
+		}
+	}
+}
+
+func mempool_have_commit(commit [32]byte) bool {
+	MempoolInfo.Guard.RLock()
+	defer MempoolInfo.Guard.RUnlock()
+	_, ok := MempoolInfo.Commits[commit]
+	return ok
+}
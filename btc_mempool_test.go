@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// the REST endpoints of a bitcoin node that only has a mempool
+type test_mempool struct {
+	txs     map[string][]byte //txid hex -> raw tx
+	verbose bool              //answer like versions before verbose=false
+	guard   sync.Mutex
+}
+
+func test_mempool_source(t testing.TB, mempool *test_mempool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mempool.guard.Lock()
+		defer mempool.guard.Unlock()
+		if r.URL.Path == "/rest/mempool/contents.json" {
+			var contents interface{}
+			if mempool.verbose {
+				verbose := make(map[string]interface{})
+				for txid := range mempool.txs {
+					verbose[txid] = map[string]interface{}{"vsize": 100}
+				}
+				contents = verbose
+			} else {
+				list := make([]string, 0)
+				for txid := range mempool.txs {
+					list = append(list, txid)
+				}
+				contents = list
+			}
+			json.NewEncoder(w).Encode(contents)
+			return
+		}
+		txid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/rest/tx/"), ".bin")
+		if raw, ok := mempool.txs[txid]; ok {
+			w.Write(raw)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	source := &RESTSource{Client: server.Client(), URL: server.URL + "/rest"}
+	test_use_source(t, source)
+	MempoolInfo.Txs = make(map[[32]byte][][32]byte)
+	MempoolInfo.Commits = make(map[[32]byte]uint64)
+}
+
+func (mempool *test_mempool) add(raw []byte) string {
+	data := append([]byte{}, raw...)
+	parsed, _, _ := btc_parse_tx(&data)
+	txid := fmt.Sprintf("%x", swap_endian(parsed))
+	mempool.guard.Lock()
+	mempool.txs[txid] = raw
+	mempool.guard.Unlock()
+	return txid
+}
+
+func (mempool *test_mempool) remove(txid string) {
+	mempool.guard.Lock()
+	delete(mempool.txs, txid)
+	mempool.guard.Unlock()
+}
+
+func test_mempool_counts(t testing.TB, txs int, counts map[int]uint64) {
+	MempoolInfo.Guard.RLock()
+	defer MempoolInfo.Guard.RUnlock()
+	if len(MempoolInfo.Txs) != txs || len(MempoolInfo.Commits) != len(counts) {
+		t.Fatalf("%d txs and %d commits pending", len(MempoolInfo.Txs), len(MempoolInfo.Commits))
+	}
+	for n, count := range counts {
+		if MempoolInfo.Commits[test_commit(n)] != count {
+			t.Fatalf("commit %d pending %d times, expected %d", n, MempoolInfo.Commits[test_commit(n)], count)
+		}
+	}
+}
+
+func TestMempool(t *testing.T) {
+	for _, verbose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verbose %v", verbose), func(t *testing.T) {
+			mempool := &test_mempool{txs: make(map[string][]byte), verbose: verbose}
+			test_mempool_source(t, mempool)
+
+			first := mempool.add(test_raw_tx(1, [][32]byte{test_commit(0), test_commit(1)}))
+			mempool.add(test_raw_tx(2, [][32]byte{test_commit(1)}))
+			mempool.add(test_raw_tx(3, nil))
+			if err := mempool_sync(); err != nil {
+				t.Fatal(err)
+			}
+			test_mempool_counts(t, 3, map[int]uint64{0: 1, 1: 2})
+			if !mempool_have_commit(test_commit(0)) || mempool_have_commit(test_commit(2)) {
+				t.Fatal("wrong commits pending")
+			}
+
+			//a mined transaction takes its commits with it, the ones another transaction has stay
+			mempool.remove(first)
+			if err := mempool_sync(); err != nil {
+				t.Fatal(err)
+			}
+			test_mempool_counts(t, 2, map[int]uint64{1: 1})
+
+			//a transaction that goes before it can be fetched is skipped, and fetched if it comes back
+			mempool.guard.Lock()
+			mempool.txs[first] = nil
+			mempool.guard.Unlock()
+			if err := mempool_sync(); err != nil {
+				t.Fatal(err)
+			}
+			test_mempool_counts(t, 2, map[int]uint64{1: 1})
+			mempool.add(test_raw_tx(1, [][32]byte{test_commit(0), test_commit(1)}))
+			if err := mempool_sync(); err != nil {
+				t.Fatal(err)
+			}
+			test_mempool_counts(t, 3, map[int]uint64{0: 1, 1: 2})
+		})
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const P2P_PROTOCOL_VERSION = 70016
+const P2P_MAX_PAYLOAD = 32 * 1024 * 1024
+const P2P_MAX_HEADERS = 2000
+const P2P_MSG_BLOCK = 2
+const P2P_BLOCKS_IN_FLIGHT = 16
+const P2P_TIMEOUT = time.Second * 60
+
+type P2PSource struct {
+	Address string
+	Conn    net.Conn
+	Height  uint64     //height the peer reported in its version message
+	Chain   [][32]byte //unknown blocks found by the last header sync
+	Guard   sync.Mutex
+}
+
+func p2p_new_source(address string) (peer *P2PSource, err error) {
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("peer must be host:port (%s)", err.Error())
+	}
+	return &P2PSource{Address: address}, nil
+}
+
+func (peer *P2PSource) Name() string {
+	return "p2p " + peer.Address
+}
+
+func (peer *P2PSource) GetChain() (ChainInfo, error) {
+	return p2p_get_chains(peer)
+}
+
+func (peer *P2PSource) GetHeaders(start [32]byte, count int) ([][80]byte, bool, error) {
+	return p2p_get_header_range(peer, start, count)
+}
+
+func (peer *P2PSource) GetBlock(hash [32]byte) (BlockData, error) {
+	return p2p_get_block(peer, hash)
+}
+
+func (peer *P2PSource) GetRawBlock(hash [32]byte) ([]byte, error) {
+	return p2p_get_raw_block(peer, hash)
+}
+
+func (peer *P2PSource) GetBlockRange(target [32]byte, length uint64, out chan<- BlockData) error {
+	return p2p_get_block_range(peer, target, length, out)
+}
+
+func p2p_checksum(payload []byte) (checksum [4]byte) {
+	hash := sha256.Sum256(payload)
+	hash = sha256.Sum256(hash[:])
+	copy(checksum[:], hash[0:4])
+	return checksum
+}
+
+func p2p_write_message(conn net.Conn, command string, payload []byte) (err error) {
+	//magic(4), command(12), length(4), checksum(4), payload(var)
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], COMBInfo.Magic)
+	copy(header[4:16], command)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(payload)))
+	checksum := p2p_checksum(payload)
+	copy(header[20:24], checksum[:])
+
+	conn.SetWriteDeadline(time.Now().Add(P2P_TIMEOUT))
+	if _, err = conn.Write(append(header[:], payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func p2p_read_message(conn net.Conn) (command string, payload []byte, err error) {
+	var header [24]byte
+
+	conn.SetReadDeadline(time.Now().Add(P2P_TIMEOUT))
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return "", nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != COMBInfo.Magic {
+		return "", nil, fmt.Errorf("peer sent wrong magic %X, is it on %s?", header[0:4], COMBInfo.Network)
+	}
+	command = string(bytes.TrimRight(header[4:16], "\x00"))
+
+	var length uint32 = binary.LittleEndian.Uint32(header[16:20])
+	if length > P2P_MAX_PAYLOAD {
+		return "", nil, fmt.Errorf("peer sent oversized %s message (%d bytes)", command, length)
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(conn, payload); err != nil {
+		return "", nil, err
+	}
+	if checksum := p2p_checksum(payload); !bytes.Equal(checksum[:], header[20:24]) {
+		return "", nil, fmt.Errorf("peer sent %s message with bad checksum", command)
+	}
+	return command, payload, nil
+}
+
+func p2p_read_until(conn net.Conn, commands ...string) (command string, payload []byte, err error) {
+	//read messages until we get one of the commands, answering pings along the way
+	for {
+		if command, payload, err = p2p_read_message(conn); err != nil {
+			return "", nil, err
+		}
+		for _, c := range commands {
+			if command == c {
+				return command, payload, nil
+			}
+		}
+		if command == "ping" {
+			if err = p2p_write_message(conn, "pong", payload); err != nil {
+				return "", nil, err
+			}
+		}
+		log_info("p2p", "ignoring %s", command)
+	}
+}
+
+func p2p_encode_version() []byte {
+	var buffer bytes.Buffer
+	var nonce [8]byte
+	var address [26]byte //services(8), ip(16), port(2), all zero is fine
+	rand.Read(nonce[:])
+
+	binary.Write(&buffer, binary.LittleEndian, int32(P2P_PROTOCOL_VERSION))
+	binary.Write(&buffer, binary.LittleEndian, uint64(0)) //services
+	binary.Write(&buffer, binary.LittleEndian, time.Now().Unix())
+	buffer.Write(address[:]) //receiver
+	buffer.Write(address[:]) //sender
+	buffer.Write(nonce[:])
+	agent := "/combcore/"
+	buffer.Write(btc_encode_varint(uint64(len(agent))))
+	buffer.WriteString(agent)
+	binary.Write(&buffer, binary.LittleEndian, int32(0)) //start height
+	buffer.WriteByte(0)                                  //relay, we dont want transactions
+	return buffer.Bytes()
+}
+
+func p2p_connect(address string) (conn net.Conn, height uint64, err error) {
+	if conn, err = net.DialTimeout("tcp", address, P2P_TIMEOUT); err != nil {
+		return nil, 0, err
+	}
+
+	if err = p2p_write_message(conn, "version", p2p_encode_version()); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	//handshake is finished once we have both the peers version and verack
+	var have_version, have_verack bool
+	for !have_version || !have_verack {
+		command, payload, err := p2p_read_until(conn, "version", "verack")
+		if err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+		switch command {
+		case "version":
+			//version(4), services(8), time(8), receiver(26), sender(26), nonce(8), agent(var), height(4)
+			if len(payload) < 81 {
+				conn.Close()
+				return nil, 0, fmt.Errorf("peer sent short version message")
+			}
+			agent_size, adv, _ := btc_parse_varint(payload[80:])
+			if offset := 80 + uint64(adv) + agent_size; adv != 0 && offset+4 <= uint64(len(payload)) {
+				height = uint64(binary.LittleEndian.Uint32(payload[offset:]))
+			}
+			have_version = true
+			if err = p2p_write_message(conn, "verack", nil); err != nil {
+				conn.Close()
+				return nil, 0, err
+			}
+		case "verack":
+			have_verack = true
+		}
+	}
+
+	log_status("p2p", "connected to %s (height %d)", address, height)
+	return conn, height, nil
+}
+
+func p2p_get_connection(peer *P2PSource) (conn net.Conn, err error) {
+	//reuse the connection if we still have one
+	if peer.Conn != nil {
+		return peer.Conn, nil
+	}
+	if peer.Conn, peer.Height, err = p2p_connect(peer.Address); err != nil {
+		return nil, err
+	}
+	return peer.Conn, nil
+}
+
+func p2p_disconnect(peer *P2PSource) {
+	if peer.Conn != nil {
+		peer.Conn.Close()
+		peer.Conn = nil
+	}
+}
+
+func p2p_locator() (locator [][32]byte) {
+	//hashes going back from our tip, dense at first and then exponentially further apart
+	COMBInfo.Guard.RLock()
+	defer COMBInfo.Guard.RUnlock()
+
+	var hash [32]byte = COMBInfo.Hash
+	var step int = 1
+	for {
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		for i := 0; i < step; i++ {
+			parent, ok := COMBInfo.Chain[hash]
+			if !ok || parent == [32]byte{} {
+				//reached the checkpoint, always end with it
+				if locator[len(locator)-1] != hash {
+					locator = append(locator, hash)
+				}
+				return locator
+			}
+			hash = parent
+		}
+	}
+}
+
+func p2p_encode_hashes(hashes [][32]byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(btc_encode_varint(uint64(len(hashes))))
+	for _, h := range hashes {
+		raw := swap_endian(h)
+		buffer.Write(raw[:])
+	}
+	return buffer.Bytes()
+}
+
+func p2p_get_headers(conn net.Conn, locator [][32]byte) (headers [][80]byte, err error) {
+	var payload []byte
+	var buffer bytes.Buffer
+	var stop [32]byte
+	binary.Write(&buffer, binary.LittleEndian, uint32(P2P_PROTOCOL_VERSION))
+	buffer.Write(p2p_encode_hashes(locator))
+	buffer.Write(stop[:])
+
+	if err = p2p_write_message(conn, "getheaders", buffer.Bytes()); err != nil {
+		return nil, err
+	}
+	if _, payload, err = p2p_read_until(conn, "headers"); err != nil {
+		return nil, err
+	}
+
+	//count(var), then header(80) and tx count(var, always 0) per header
+	count, adv, err := btc_parse_varint(payload)
+	if err != nil {
+		return nil, err
+	}
+	payload = payload[adv:]
+	if count > P2P_MAX_HEADERS || uint64(len(payload)) < count*81 {
+		return nil, fmt.Errorf("peer sent malformed headers")
+	}
+	headers = make([][80]byte, count)
+	for i := range headers {
+		copy(headers[i][:], payload[0:80])
+		payload = payload[81:]
+	}
+	return headers, nil
+}
+
+func p2p_get_header_range(peer *P2PSource, start [32]byte, count int) (headers [][80]byte, found bool, err error) {
+	peer.Guard.Lock()
+	defer peer.Guard.Unlock()
+
+	var conn net.Conn
+	if conn, err = p2p_get_connection(peer); err != nil {
+		return nil, false, err
+	}
+	if headers, err = p2p_get_headers(conn, [][32]byte{start}); err != nil {
+		p2p_disconnect(peer)
+		return nil, false, err
+	}
+	//the peer starts from genesis if start isnt on its best chain, nothing comes back if start is its tip
+	if len(headers) != 0 {
+		if _, previous := btc_parse_header(headers[0]); previous != start {
+			return nil, false, nil
+		}
+	}
+	if len(headers) > count {
+		headers = headers[:count]
+	}
+	return headers, true, nil
+}
+
+func p2p_trace_chain(conn net.Conn) (chain [][32]byte, fork [32]byte, err error) {
+	//ask the peer for headers after our chain, the first header links to the highest block we have in common
+	var headers [][80]byte
+	var locator [][32]byte = p2p_locator()
+	fork = locator[0]
+
+	for {
+		if headers, err = p2p_get_headers(conn, locator); err != nil {
+			return nil, fork, err
+		}
+
+		for _, header := range headers {
+			hash, previous := btc_parse_header(header)
+
+			if len(chain) == 0 {
+				COMBInfo.Guard.RLock()
+				_, ok := COMBInfo.Chain[previous]
+				COMBInfo.Guard.RUnlock()
+				if !ok {
+					return nil, fork, fmt.Errorf("peer sent header %X that doesnt connect", hash)
+				}
+				fork = previous
+			} else if previous != chain[len(chain)-1] {
+				return nil, fork, fmt.Errorf("peer sent headers out of order at %X", hash)
+			}
+			chain = append(chain, hash)
+		}
+
+		if len(headers) < P2P_MAX_HEADERS {
+			break //peer has nothing more
+		}
+		locator = [][32]byte{chain[len(chain)-1]}
+		combcore_set_status(fmt.Sprintf("Tracing (%d headers)...", len(chain)))
+	}
+	return chain, fork, nil
+}
+
+func p2p_get_chains(peer *P2PSource) (chain ChainInfo, err error) {
+	peer.Guard.Lock()
+	defer peer.Guard.Unlock()
+
+	var conn net.Conn
+	var fork [32]byte
+	if conn, err = p2p_get_connection(peer); err != nil {
+		return chain, err
+	}
+	if peer.Chain, fork, err = p2p_trace_chain(conn); err != nil {
+		p2p_disconnect(peer)
+		return chain, err
+	}
+
+	//work out the height of the fork point from our in-memory chain
+	COMBInfo.Guard.RLock()
+	var height uint64 = COMBInfo.Height
+	for hash := COMBInfo.Hash; hash != fork && hash != [32]byte{}; hash = COMBInfo.Chain[hash] {
+		height--
+	}
+	COMBInfo.Guard.RUnlock()
+
+	chain.TopHash = fork
+	if len(peer.Chain) != 0 {
+		chain.TopHash = peer.Chain[len(peer.Chain)-1]
+	}
+	chain.Height = height + uint64(len(peer.Chain))
+	chain.KnownHeight = chain.Height
+	if peer.Height > chain.KnownHeight {
+		chain.KnownHeight = peer.Height
+	}
+	return chain, nil
+}
+
+func p2p_send_getdata(conn net.Conn, hashes [][32]byte) error {
+	var buffer bytes.Buffer
+	buffer.Write(btc_encode_varint(uint64(len(hashes))))
+	for _, h := range hashes {
+		raw := swap_endian(h)
+		binary.Write(&buffer, binary.LittleEndian, uint32(P2P_MSG_BLOCK))
+		buffer.Write(raw[:])
+	}
+	return p2p_write_message(conn, "getdata", buffer.Bytes())
+}
+
+func p2p_get_blocks(conn net.Conn, hashes [][32]byte) (blocks map[[32]byte]*BlockData, err error) {
+	//request a batch of blocks and wait for all of them to arrive
+	if err = p2p_send_getdata(conn, hashes); err != nil {
+		return nil, err
+	}
+
+	blocks = make(map[[32]byte]*BlockData)
+	for len(blocks) < len(hashes) {
+		command, payload, err := p2p_read_until(conn, "block", "notfound")
+		if err != nil {
+			return nil, err
+		}
+		if command == "notfound" {
+			return nil, fmt.Errorf("peer does not have the requested blocks")
+		}
+		block := new(BlockData)
+		if err = btc_parse_block(payload, block); err != nil {
+			return nil, fmt.Errorf("peer sent a malformed block (%s)", err.Error())
+		}
+		for _, h := range hashes {
+			if h == block.Hash {
+				blocks[block.Hash] = block
+			}
+		}
+	}
+	return blocks, nil
+}
+
+func p2p_get_block(peer *P2PSource, hash [32]byte) (block BlockData, err error) {
+	peer.Guard.Lock()
+	defer peer.Guard.Unlock()
+
+	var conn net.Conn
+	var blocks map[[32]byte]*BlockData
+	if conn, err = p2p_get_connection(peer); err != nil {
+		return block, err
+	}
+	if blocks, err = p2p_get_blocks(conn, [][32]byte{hash}); err != nil {
+		p2p_disconnect(peer)
+		return block, err
+	}
+	return *blocks[hash], nil
+}
+
+func p2p_get_raw_block(peer *P2PSource, hash [32]byte) (raw_data []byte, err error) {
+	peer.Guard.Lock()
+	defer peer.Guard.Unlock()
+
+	var conn net.Conn
+	var command string
+	if conn, err = p2p_get_connection(peer); err != nil {
+		return nil, err
+	}
+	if err = p2p_send_getdata(conn, [][32]byte{hash}); err != nil {
+		p2p_disconnect(peer)
+		return nil, err
+	}
+	if command, raw_data, err = p2p_read_until(conn, "block", "notfound"); err != nil {
+		p2p_disconnect(peer)
+		return nil, err
+	}
+	if command == "notfound" {
+		return nil, fmt.Errorf("peer does not have block %X", hash)
+	}
+	if err = btc_check_raw_block(raw_data, hash); err != nil {
+		p2p_disconnect(peer)
+		return nil, err
+	}
+	return raw_data, nil
+}
+
+func p2p_get_block_range(peer *P2PSource, target [32]byte, length uint64, out chan<- BlockData) (err error) {
+	peer.Guard.Lock()
+	defer peer.Guard.Unlock()
+
+	var conn net.Conn
+	var blocks map[[32]byte]*BlockData
+	if conn, err = p2p_get_connection(peer); err != nil {
+		return err
+	}
+
+	//the chain was traced when we got the chain info, cut it at the target
+	var chain [][32]byte
+	for i, h := range peer.Chain {
+		if h == target {
+			chain = peer.Chain[:i+1]
+			break
+		}
+	}
+	if chain == nil {
+		return fmt.Errorf("target %X is not in the traced chain", target)
+	}
+
+	log_status("p2p", "getting %d blocks...", len(chain))
+
+	for i := 0; i < len(chain); i += P2P_BLOCKS_IN_FLIGHT {
+		end := i + P2P_BLOCKS_IN_FLIGHT
+		if end > len(chain) {
+			end = len(chain)
+		}
+		if blocks, err = p2p_get_blocks(conn, chain[i:end]); err != nil {
+			p2p_disconnect(peer)
+			return err
+		}
+		for _, h := range chain[i:end] {
+			block, ok := blocks[h]
+			if !ok {
+				p2p_disconnect(peer)
+				return fmt.Errorf("peer did not send block %X", h)
+			}
+			out <- *block
+		}
+
+		var progress float64 = (float64(end) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
+	}
+	return nil
+}
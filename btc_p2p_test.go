@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// a bitcoin node on localhost that serves a chain of raw blocks over the P2P protocol
+type test_peer struct {
+	listener net.Listener
+	genesis  [32]byte
+	raw      [][]byte
+	hashes   [][32]byte
+	height   uint32
+}
+
+func test_new_peer(t testing.TB, genesis [32]byte, raw [][]byte) *test_peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &test_peer{listener: listener, genesis: genesis, raw: raw, height: 1234}
+	for _, block := range raw {
+		var header [80]byte
+		copy(header[:], block[0:80])
+		hash, _ := btc_parse_header(header)
+		peer.hashes = append(peer.hashes, hash)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go peer.serve(conn)
+		}
+	}()
+	return peer
+}
+
+func (peer *test_peer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		command, payload, err := p2p_read_message(conn)
+		if err != nil {
+			return
+		}
+		switch command {
+		case "version":
+			var version bytes.Buffer
+			version.Write(p2p_encode_version()[0:80])
+			version.Write(btc_encode_varint(4))
+			version.WriteString("fake")
+			binary.Write(&version, binary.LittleEndian, peer.height)
+			p2p_write_message(conn, "ping", []byte{1, 2, 3, 4, 5, 6, 7, 8}) //has to be answered mid handshake
+			p2p_write_message(conn, "version", version.Bytes())
+			p2p_write_message(conn, "verack", nil)
+		case "getheaders":
+			p2p_write_message(conn, "headers", peer.headers(payload))
+		case "getdata":
+			peer.send_blocks(conn, payload)
+		}
+	}
+}
+
+func (peer *test_peer) index(hash [32]byte) int {
+	//-1 for genesis, -2 if the hash isnt on our chain
+	if hash == peer.genesis {
+		return -1
+	}
+	for i, h := range peer.hashes {
+		if h == hash {
+			return i
+		}
+	}
+	return -2
+}
+
+func (peer *test_peer) headers(payload []byte) []byte {
+	//headers after the first locator hash we know, from genesis like bitcoin core if we know none of them
+	count, adv, _ := btc_parse_varint(payload[4:])
+	var start int = -1
+	for i := uint64(0); i < count; i++ {
+		var raw, hash [32]byte
+		copy(raw[:], payload[4+int(adv)+32*int(i):])
+		hash = swap_endian(raw)
+		if found := peer.index(hash); found != -2 {
+			start = found
+			break
+		}
+	}
+
+	var headers bytes.Buffer
+	var end int = len(peer.raw)
+	if end > start+1+P2P_MAX_HEADERS {
+		end = start + 1 + P2P_MAX_HEADERS
+	}
+	headers.Write(btc_encode_varint(uint64(end - start - 1)))
+	for _, raw := range peer.raw[start+1 : end] {
+		headers.Write(raw[0:80])
+		headers.WriteByte(0)
+	}
+	return headers.Bytes()
+}
+
+func (peer *test_peer) send_blocks(conn net.Conn, payload []byte) {
+	count, adv, _ := btc_parse_varint(payload)
+	var missing [][]byte
+	for i := uint64(0); i < count; i++ {
+		item := payload[int(adv)+36*int(i) : int(adv)+36*int(i+1)]
+		var raw [32]byte
+		copy(raw[:], item[4:36])
+		if found := peer.index(swap_endian(raw)); found >= 0 {
+			p2p_write_message(conn, "block", peer.raw[found])
+		} else {
+			missing = append(missing, item)
+		}
+	}
+	if len(missing) != 0 {
+		var notfound bytes.Buffer
+		notfound.Write(btc_encode_varint(uint64(len(missing))))
+		for _, item := range missing {
+			notfound.Write(item)
+		}
+		p2p_write_message(conn, "notfound", notfound.Bytes())
+	}
+}
+
+func test_peer_chain(t testing.TB, previous [32]byte, length int) (raw [][]byte, chain []BlockData) {
+	for i := 0; i < length; i++ {
+		test_block_count++
+		raw = append(raw, test_raw_block(previous, test_raw_tx(test_block_count, [][32]byte{test_commit(i)})))
+		var block BlockData
+		if err := btc_parse_block(raw[i], &block); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, block)
+		previous = block.Hash
+	}
+	return raw, chain
+}
+
+func TestP2PHandshake(t *testing.T) {
+	test_setup(t)
+	peer := test_new_peer(t, COMBInfo.Hash, nil)
+
+	conn, height, err := p2p_connect(peer.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if height != 1234 {
+		t.Fatalf("peer reported height %d", height)
+	}
+
+}
+
+func TestP2PGetHeaders(t *testing.T) {
+	test_setup(t)
+	raw, chain := test_peer_chain(t, COMBInfo.Hash, 20)
+	peer := test_new_peer(t, COMBInfo.Hash, raw)
+	source, _ := p2p_new_source(peer.listener.Addr().String())
+	defer p2p_disconnect(source)
+
+	headers, found, err := source.GetHeaders(chain[4].Hash, 10)
+	if err != nil || !found || len(headers) != 10 || headers[0] != chain[5].Header || headers[9] != chain[14].Header {
+		t.Fatalf("got %d headers after block 4 (%v %v)", len(headers), found, err)
+	}
+	headers, found, err = source.GetHeaders(COMBInfo.Hash, BTC_MAX_HEADERS)
+	if err != nil || !found || len(headers) != 20 {
+		t.Fatalf("got %d headers after genesis (%v %v)", len(headers), found, err)
+	}
+	if headers, found, err = source.GetHeaders(chain[19].Hash, 10); err != nil || !found || len(headers) != 0 {
+		t.Fatalf("got %d headers after the tip (%v %v)", len(headers), found, err)
+	}
+
+	//a block the peer doesnt have, it answers from genesis
+	_, other := test_peer_chain(t, COMBInfo.Hash, 2)
+	if headers, found, err = source.GetHeaders(other[1].Hash, 10); err != nil || found {
+		t.Fatalf("block off the peers chain was found (%d headers, %v)", len(headers), err)
+	}
+}
+
+func TestP2PGetBlocks(t *testing.T) {
+	test_setup(t)
+	raw, chain := test_peer_chain(t, COMBInfo.Hash, 20)
+	peer := test_new_peer(t, COMBInfo.Hash, raw)
+	source, _ := p2p_new_source(peer.listener.Addr().String())
+	defer p2p_disconnect(source)
+
+	if block, err := source.GetBlock(chain[3].Hash); err != nil || block.Hash != chain[3].Hash || block.Commits[0] != test_commit(3) {
+		t.Fatalf("got %X (%v)", block.Hash, err)
+	}
+	if data, err := source.GetRawBlock(chain[7].Hash); err != nil || !bytes.Equal(data, raw[7]) {
+		t.Fatalf("got %d bytes (%v)", len(data), err)
+	}
+
+	_, other := test_peer_chain(t, COMBInfo.Hash, 1)
+	if _, err := source.GetBlock(other[0].Hash); err == nil {
+		t.Fatal("peer sent a block it doesnt have")
+	}
+	if _, err := source.GetRawBlock(other[0].Hash); err == nil {
+		t.Fatal("peer sent a raw block it doesnt have")
+	}
+
+	//the whole chain in order, more blocks than are requested at once
+	info, err := source.GetChain()
+	if err != nil || info.TopHash != chain[19].Hash || info.Height != COMBInfo.Height+20 || info.KnownHeight != 1234 {
+		t.Fatalf("chain info %v (%v)", info, err)
+	}
+	var out chan BlockData = make(chan BlockData, len(chain))
+	if err = source.GetBlockRange(chain[19].Hash, 20, out); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	var i int
+	for block := range out {
+		if block.Hash != chain[i].Hash {
+			t.Fatalf("block %d is %X", i, block.Hash)
+		}
+		i++
+	}
+	if i != 20 {
+		t.Fatalf("got %d blocks", i)
+	}
+}
@@ -4,100 +4,155 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"time"
 )
 
-func rest_trace_chain(client *http.Client, url string, target [32]byte, length uint64) (chain [][32]byte, err error) {
-	var raw_json json.RawMessage
-	var headers []struct {
-		Height            uint64
-		Previousblockhash string
+const REST_MAX_HEADERS = 2000
+
+type RESTSource struct {
+	Client *http.Client
+	URL    string
+}
+
+func rest_new_source(peer string) *RESTSource {
+	//peers are host or host:port, btc_port is used when the port is left out
+	if _, _, err := net.SplitHostPort(peer); err != nil {
+		peer = fmt.Sprintf("%s:%d", peer, *btc_port)
 	}
+	var source *RESTSource = new(RESTSource)
+	source.URL = fmt.Sprintf("http://%s/rest", peer)
+	source.Client = &http.Client{}
+	source.Client.Timeout = time.Second * time.Duration(*btc_rest_timeout)
+	return source
+}
 
-	//keep tracing the chain back from the tip until we find a block thats known (in history)
-	var hash [32]byte = target
+func (source *RESTSource) Name() string {
+	return "rest " + source.URL
+}
 
-	for {
-		COMBInfo.Guard.RLock()
-		_, ok := COMBInfo.Chain[hash]
-		COMBInfo.Guard.RUnlock()
-		if ok {
-			break
-		}
+func (source *RESTSource) GetChain() (ChainInfo, error) {
+	return rest_get_chains(source.Client, source.URL)
+}
 
-		chain = append(chain, hash)
-		if raw_json, err = btc_rest_call(client, fmt.Sprintf("%s/headers/1/%x.json", url, hash)); err != nil {
-			return nil, err
-		}
-		if err = json.Unmarshal(raw_json, &headers); err != nil {
-			return nil, fmt.Errorf("header is gibberish (%s) got (%s)", err.Error(), string(raw_json))
-		}
-		if len(headers) == 0 {
-			return nil, fmt.Errorf("cannot find header for %X", hash)
-		}
-		if hash, err = parse_hex(headers[0].Previousblockhash); err != nil {
-			return nil, err
-		}
+func (source *RESTSource) GetHeaders(start [32]byte, count int) ([][80]byte, bool, error) {
+	return rest_get_header_range(source.Client, source.URL, start, count)
+}
+
+func (source *RESTSource) GetBlock(hash [32]byte) (BlockData, error) {
+	return rest_get_block_retry(source.Client, source.URL, hash)
+}
 
-		log_info("rest", "tracing %X", hash)
+func (source *RESTSource) GetRawBlock(hash [32]byte) ([]byte, error) {
+	return rest_get_raw_block(source.Client, source.URL, hash)
+}
+
+func (source *RESTSource) GetBlockRange(target [32]byte, length uint64, out chan<- BlockData) error {
+	return rest_get_block_range(source, target, length, out)
+}
+
+func rest_get_headers(client *http.Client, url string, hash [32]byte, count int) (headers [][80]byte, err error) {
+	var raw_data []byte
 
-		//just for the end user, this wont factor in any reorgs
-		var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
-		combcore_set_status(fmt.Sprintf("Tracing (%.2f%%)...", progress))
+	//headers going forward from hash along the peers best chain, empty if hash isnt on it
+	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/headers/%x.bin?count=%d", url, hash, count)); err != nil {
+		//older versions only support the count in the path
+		if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/headers/%d/%x.bin", url, count, hash)); err != nil {
+			return nil, err
+		}
+	}
+	if len(raw_data)%80 != 0 {
+		return nil, fmt.Errorf("headers are gibberish (got %d bytes)", len(raw_data))
 	}
 
-	//reverse the chain so older blocks are mined first
-	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
-		chain[i], chain[j] = chain[j], chain[i]
+	headers = make([][80]byte, len(raw_data)/80)
+	for i := range headers {
+		copy(headers[i][:], raw_data[i*80:(i+1)*80])
 	}
+	return headers, nil
+}
 
-	return chain, nil
+func rest_get_header_range(client *http.Client, url string, start [32]byte, count int) (headers [][80]byte, found bool, err error) {
+	//REST includes start itself, which leaves one less slot for the headers after it
+	if count >= REST_MAX_HEADERS {
+		count = REST_MAX_HEADERS - 1
+	}
+	if headers, err = rest_get_headers(client, url, start, count+1); err != nil {
+		return nil, false, err
+	}
+	if len(headers) == 0 {
+		return nil, false, nil
+	}
+	if hash, _ := btc_parse_header(headers[0]); hash != start {
+		return nil, false, fmt.Errorf("recieved wrong header %X != %X", hash, start)
+	}
+	return headers[1:], true, nil
 }
 
-func rest_get_block_range(client *http.Client, url string, target [32]byte, length uint64, out chan<- BlockData) (err error) {
-	defer close(out)
+func rest_get_block_range(source *RESTSource, target [32]byte, length uint64, out chan<- BlockData) (err error) {
 	var chain [][32]byte
-	var block BlockData
 
 	//gets a list of blocks that connect the target to a known block (does not have to be the current chain tip)
 	//every block in this list is unknown to combcore
 
 	log_status("rest", "tracing chain...")
 
-	if chain, err = rest_trace_chain(client, url, target, length); err != nil {
+	if chain, err = btc_trace_chain(source, target, length); err != nil {
 		return err
 	}
 
-	log_status("rest", "getting blocks...")
+	log_status("rest", "getting %d blocks...", len(chain))
+
+	//blocks are ingested in order as they arrive, so a failed sync resumes from the last ingested block
+	fetch := func(i int) (BlockData, error) {
+		return source.GetBlock(chain[i])
+	}
+	return btc_fetch_ordered(len(chain), int(*btc_rest_workers), fetch, out)
+}
 
-	for i, h := range chain {
-		if block, err = rest_get_block(client, url, h); err != nil {
-			return err
+func rest_get_block_retry(client *http.Client, url string, hash [32]byte) (block BlockData, err error) {
+	var backoff time.Duration = time.Second
+	for attempt := uint(0); ; attempt++ {
+		if block, err = rest_get_block(client, url, hash); err == nil {
+			return block, nil
+		}
+		if attempt >= *btc_rest_retries {
+			return block, fmt.Errorf("giving up on block %X (%s)", hash, err.Error())
+		}
+		log_error("rest", "failed to get block %X, retrying in %s (%s)", hash, backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff < time.Second*30 {
+			backoff *= 2
 		}
-		var progress float64 = (float64(i) / float64(length)) * 100.0
-		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
-		out <- block
 	}
+}
 
-	return nil
+func rest_get_raw_block(client *http.Client, url string, hash [32]byte) (raw_data []byte, err error) {
+	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/block/%x.bin", url, hash)); err != nil {
+		return nil, err
+	}
+	if err = btc_check_raw_block(raw_data, hash); err != nil {
+		return nil, err
+	}
+	return raw_data, nil
 }
 
 func rest_get_block(client *http.Client, url string, hash [32]byte) (block BlockData, err error) {
 	var raw_data []byte
 	var raw_block *BlockData = new(BlockData)
 
-	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/block/%x.bin", url, hash)); err != nil {
+	if raw_data, err = rest_get_raw_block(client, url, hash); err != nil {
 		return block, err
 	}
 
-	btc_parse_block(raw_data, raw_block)
-
-	if raw_block.Hash != hash {
-		log_panic("rest", "recieved wrong block %X != %X", raw_block.Hash, hash)
+	if err = btc_parse_block(raw_data, raw_block); err != nil {
+		return block, fmt.Errorf("block %X is malformed (%s)", hash, err.Error())
 	}
 
 	block.Hash = raw_block.Hash
 	block.Previous = raw_block.Previous
+	block.Header = raw_block.Header
 	block.Commits = raw_block.Commits
 
 	return block, nil
@@ -106,6 +161,7 @@ func rest_get_block(client *http.Client, url string, hash [32]byte) (block Block
 func rest_get_chains(client *http.Client, url string) (chain ChainInfo, err error) {
 	var raw_json json.RawMessage
 	var raw_chain struct {
+		Chain         string
 		Blocks        uint64
 		Headers       uint64
 		BestBlockHash string
@@ -125,6 +181,7 @@ func rest_get_chains(client *http.Client, url string) (chain ChainInfo, err erro
 
 	chain.Height = raw_chain.Blocks
 	chain.KnownHeight = raw_chain.Headers
+	chain.Network = raw_chain.Chain
 
 	return chain, nil
 }
@@ -138,7 +195,8 @@ func btc_rest_call(client *http.Client, url string) (json.RawMessage, error) {
 	}
 
 	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("response not OK")
+		response.Body.Close()
+		return nil, fmt.Errorf("response not OK (%s)", response.Status)
 	}
 
 	response_data, err := ioutil.ReadAll(response.Body)
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+)
+
+const BTC_MAX_HEADERS = 2000
+
+// what bitcoin core calls each network and the magic at the start of its messages and block records
+var BTC_NETWORKS = map[string]struct {
+	Chain string
+	Magic uint32
+}{
+	"mainnet": {"main", 0xd9b4bef9},
+	"testnet": {"test", 0x0709110b},
+	"regtest": {"regtest", 0xdab5bffa},
+	"signet":  {"signet", 0x40cf030a},
+}
+
+func btc_network_by_magic(magic uint32) string {
+	for name, network := range BTC_NETWORKS {
+		if network.Magic == magic {
+			return name
+		}
+	}
+	return ""
+}
+
+// somewhere blocks can be mined from (a REST peer, a P2P peer, the bitcoin data directory...)
+type BlockSource interface {
+	Name() string
+	GetChain() (ChainInfo, error)
+	//headers after start along the sources best chain, found is false if start isnt on it
+	GetHeaders(start [32]byte, count int) (headers [][80]byte, found bool, err error)
+	GetBlock(hash [32]byte) (BlockData, error)
+	//the block as bitcoin serializes it, for passing on to someone who checks it themselves
+	GetRawBlock(hash [32]byte) ([]byte, error)
+	//blocks from our chain up to target, sent in order
+	GetBlockRange(target [32]byte, length uint64, out chan<- BlockData) error
+}
+
+func btc_find_start(source BlockSource) (start [32]byte, ours [][32]byte, err error) {
+	//find the highest block of our chain thats still on the sources best chain
+	//ours is our chain after start, these blocks are only new if the source disagrees with them
+	var found bool
+	var step int = 1
+
+	COMBInfo.Guard.RLock()
+	start = COMBInfo.Hash
+	COMBInfo.Guard.RUnlock()
+
+	for {
+		if _, found, err = source.GetHeaders(start, 1); err != nil {
+			return start, nil, err
+		}
+		if found {
+			break
+		}
+
+		//our block was reorged out, go further back
+		COMBInfo.Guard.RLock()
+		for i := 0; i < step; i++ {
+			parent, ok := COMBInfo.Chain[start]
+			if !ok || parent == [32]byte{} {
+				COMBInfo.Guard.RUnlock()
+				return start, nil, fmt.Errorf("cannot find header for %X", start)
+			}
+			ours = append([][32]byte{start}, ours...)
+			start = parent
+		}
+		COMBInfo.Guard.RUnlock()
+		step *= 2
+
+		log_status("btc", "tip not on best chain, trying %X", start)
+	}
+
+	return start, ours, nil
+}
+
+func btc_trace_chain(source BlockSource, target [32]byte, length uint64) (chain [][32]byte, err error) {
+	var headers [][80]byte
+	var found bool
+	var start [32]byte
+	var ours [][32]byte
+
+	//go forward from a known block in batches, checking hashes and links ourselves
+	if start, ours, err = btc_find_start(source); err != nil {
+		return nil, err
+	}
+
+	var previous [32]byte = start
+	var matching bool = true
+	var position int = 0
+
+	for previous != target {
+		if headers, found, err = source.GetHeaders(previous, BTC_MAX_HEADERS); err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("cannot find header for %X", previous)
+		}
+		if len(headers) == 0 {
+			return nil, fmt.Errorf("target %X is not on the best chain of %s", target, source.Name())
+		}
+
+		for _, header := range headers {
+			hash, parent := btc_parse_header(header)
+			if parent != previous {
+				return nil, fmt.Errorf("header %X does not link to %X", hash, previous)
+			}
+			previous = hash
+
+			//skip blocks we already have, until the chains diverge
+			if matching && position < len(ours) && ours[position] == hash {
+				position++
+			} else {
+				matching = false
+				chain = append(chain, hash)
+			}
+
+			if hash == target {
+				break
+			}
+		}
+
+		log_info("btc", "tracing %X", previous)
+
+		//just for the end user, this wont factor in any reorgs
+		var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Tracing (%.2f%%)...", progress))
+	}
+
+	return chain, nil
+}
+
+func btc_check_sources(sources []BlockSource, chosen int, chain ChainInfo) (err error) {
+	//every other reachable source must have the tip on its best chain, otherwise someone is on a fork (or lying)
+	var found bool
+	for i, source := range sources {
+		if i == chosen {
+			continue
+		}
+		if _, found, err = source.GetHeaders(chain.TopHash, 1); err != nil {
+			log_error("btc", "cannot cross check with %s (%s)", source.Name(), err.Error())
+			continue
+		}
+		if !found {
+			return fmt.Errorf("%s does not have tip %X from %s", source.Name(), chain.TopHash, sources[chosen].Name())
+		}
+	}
+	return nil
+}
+
+func btc_check_network(source BlockSource, chain ChainInfo) (mismatch error, err error) {
+	//make sure the source is on our network, otherwise tracing fails in confusing ways
+	var found bool
+	if network, ok := BTC_NETWORKS[COMBInfo.Network]; ok && chain.Network != "" && chain.Network != network.Chain {
+		return fmt.Errorf("%s is on %s, we are on %s", source.Name(), chain.Network, COMBInfo.Network), nil
+	}
+
+	COMBInfo.Guard.RLock()
+	var checkpoint [32]byte = COMBInfo.Checkpoint
+	COMBInfo.Guard.RUnlock()
+
+	if _, found, err = source.GetHeaders(checkpoint, 1); err != nil {
+		return nil, err
+	}
+	if !found {
+		return fmt.Errorf("checkpoint %X is not on the best chain of %s, wrong network?", checkpoint, source.Name()), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// mainnet genesis block, a single non segwit transaction and no commits
+const TEST_GENESIS_BLOCK = "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c0101000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+const TEST_GENESIS_HASH = "000000000019D6689C085AE165831E934FF763AE46A2A6C172B3F1B60A8CE26F"
+
+// a bitcoin node that only knows the chain its given
+type test_source struct {
+	chain []BlockData
+}
+
+func (source *test_source) Name() string {
+	return "test"
+}
+
+func (source *test_source) GetChain() (chain ChainInfo, err error) {
+	chain.TopHash = source.chain[len(source.chain)-1].Hash
+	chain.Height = uint64(len(source.chain))
+	return chain, nil
+}
+
+func (source *test_source) GetHeaders(start [32]byte, count int) (headers [][80]byte, found bool, err error) {
+	found = start == COMBInfo.Checkpoint
+	for _, block := range source.chain {
+		if found && len(headers) < count {
+			headers = append(headers, block.Header)
+		}
+		if block.Hash == start {
+			found = true
+		}
+	}
+	return headers, found, nil
+}
+
+func (source *test_source) GetBlock(hash [32]byte) (block BlockData, err error) {
+	for _, block = range source.chain {
+		if block.Hash == hash {
+			return block, nil
+		}
+	}
+	return block, fmt.Errorf("unknown block %X", hash)
+}
+
+func (source *test_source) GetRawBlock(hash [32]byte) ([]byte, error) {
+	return nil, fmt.Errorf("unknown block %X", hash)
+}
+
+func (source *test_source) GetBlockRange(target [32]byte, length uint64, out chan<- BlockData) error {
+	//everything after the last block we have, up to target
+	var first int
+	for i, block := range source.chain {
+		COMBInfo.Guard.RLock()
+		_, ok := COMBInfo.Chain[block.Hash]
+		COMBInfo.Guard.RUnlock()
+		if ok {
+			first = i + 1
+		}
+		if block.Hash == target {
+			for _, block = range source.chain[first : i+1] {
+				out <- block
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown block %X", target)
+}
+
+// sends part of the range twice, like direct mining failing and a peer continuing from the last ingested block
+type test_repeat_source struct {
+	test_source
+	repeat int
+}
+
+func (source *test_repeat_source) GetBlockRange(target [32]byte, length uint64, out chan<- BlockData) error {
+	for _, block := range source.chain[:source.repeat] {
+		out <- block
+	}
+	return source.test_source.GetBlockRange(target, length, out)
+}
+
+func test_use_source(t testing.TB, source BlockSource) {
+	BTCInfo.Sources = []BlockSource{source}
+	BTCInfo.Verified = []bool{false}
+	BTCInfo.Source = 0
+	BTCInfo.Mismatch = ""
+	t.Cleanup(func() { BTCInfo.Sources = nil })
+}
+
+// a source that hangs in GetChain until its released
+type test_slow_source struct {
+	test_source
+	waiting chan bool
+	release chan bool
+}
+
+func (source *test_slow_source) GetChain() (ChainInfo, error) {
+	source.waiting <- true
+	<-source.release
+	return source.test_source.GetChain()
+}
+
+func TestGetChainsUnlocked(t *testing.T) {
+	//status must be available while a source takes its time, and writers to COMBInfo must not get stuck behind it
+	test_setup(t)
+	chain := test_chain(t, COMBInfo.Hash, 3, 0)
+	source := &test_slow_source{test_source{chain}, make(chan bool), make(chan bool)}
+	test_use_source(t, source)
+
+	done := make(chan error)
+	go func() { done <- btc_get_chains() }()
+	<-source.waiting
+
+	status := make(chan bool)
+	go func() {
+		COMBInfo.Guard.Lock()
+		COMBInfo.Guard.Unlock()
+		var reply StatusReply
+		new(Control).GetStatus(nil, &reply)
+		status <- true
+	}()
+	select {
+	case <-status:
+	case <-time.After(5 * time.Second):
+		t.Fatal("status blocked on a source")
+	}
+
+	close(source.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if BTCInfo.Chain.TopHash != chain[2].Hash || !BTCInfo.Verified[0] {
+		t.Fatalf("chain was not stored")
+	}
+}
+
+func test_pending(t testing.TB, chain []BlockData, first int) {
+	//the pending blocks are the chain from first onwards, at their heights
+	var reply []PendingBlockReply
+	new(Control).GetPendingBlocks(nil, &reply)
+	if len(reply) != len(chain)-first {
+		t.Fatalf("%d blocks pending, expected %d", len(reply), len(chain)-first)
+	}
+	for i, p := range reply {
+		if p.Hash != stringify_hex(chain[first+i].Hash) || p.Height != uint64(first+i+1) {
+			t.Fatalf("pending %d is %s at %d", i, p.Hash, p.Height)
+		}
+	}
+}
+
+func TestHoldBack(t *testing.T) {
+	test_setup(t)
+	flag.Set("btc_min_confirmations", "3")
+	t.Cleanup(func() { flag.Set("btc_min_confirmations", "0") })
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+
+	test_use_source(t, &test_source{chain[:6]})
+	btc_sync()
+	if COMBInfo.Hash != chain[2].Hash {
+		t.Fatalf("ingested to %d", COMBInfo.Height)
+	}
+	test_pending(t, chain[:6], 3)
+
+	//nothing new, the held blocks stay held
+	btc_sync()
+	if COMBInfo.Hash != chain[2].Hash {
+		t.Fatalf("ingested to %d", COMBInfo.Height)
+	}
+
+	//blocks sent again, some already ingested and some held, are not held twice
+	test_use_source(t, &test_repeat_source{test_source{chain}, 8})
+	btc_sync()
+	if COMBInfo.Hash != chain[6].Hash {
+		t.Fatalf("ingested to %d", COMBInfo.Height)
+	}
+	test_pending(t, chain, 7)
+}
+
+func TestFillHeaders(t *testing.T) {
+	storage := test_crashable(t)
+	var start uint64 = COMBInfo.Height
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	//a db from before headers were kept, except for one block
+	for height := start + 1; height <= start+10; height++ {
+		if height != start+5 {
+			test_strip_header(t, height)
+		}
+	}
+	test_restart(storage)
+	if DBInfo.MissingHeaders != 9 || DBInfo.MissingFrom != start+1 || COMBInfo.Header != [80]byte{} {
+		t.Fatalf("%d headers missing from %d", DBInfo.MissingHeaders, DBInfo.MissingFrom)
+	}
+
+	//a source on a different chain fills nothing
+	test_use_source(t, &test_source{test_chain(t, COMBInfo.Checkpoint, 10, 100)})
+	btc_fill_headers()
+	if DBInfo.MissingHeaders != 9 {
+		t.Fatalf("filled headers from another chain")
+	}
+
+	test_use_source(t, &test_source{chain})
+	btc_fill_headers()
+	if DBInfo.MissingHeaders != 0 || COMBInfo.Header != chain[9].Header {
+		t.Fatalf("%d headers still missing", DBInfo.MissingHeaders)
+	}
+	for i, block := range chain {
+		if db_get_block_metadata_by_height(start+uint64(i)+1).Header != block.Header {
+			t.Fatalf("header %d was not filled", i)
+		}
+	}
+	if _, _, err := bootstrap_export(t.TempDir() + "/bootstrap.gz"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func test_segwit_tx(stripped []byte) []byte {
+	//the same transaction with a marker, flag and a witness of two items for its one input
+	var tx bytes.Buffer
+	tx.Write(stripped[0:4])
+	tx.Write([]byte{0x00, 0x01})
+	tx.Write(stripped[4 : len(stripped)-4])
+	tx.Write(btc_encode_varint(2))
+	tx.Write(btc_encode_varint(72))
+	tx.Write(bytes.Repeat([]byte{0x30}, 72))
+	tx.Write(btc_encode_varint(33))
+	tx.Write(bytes.Repeat([]byte{0x02}, 33))
+	tx.Write(stripped[len(stripped)-4:])
+	return tx.Bytes()
+}
+
+func TestParseVarint(t *testing.T) {
+	for _, c := range []struct {
+		data    string
+		value   uint64
+		advance uint8
+	}{
+		{"00", 0, 1},
+		{"fc", 0xfc, 1},
+		{"fdfd00", 0xfd, 3},
+		{"fdffff", 0xffff, 3},
+		{"fd0100", 1, 3}, //not the shortest encoding, bitcoin still reads it
+		{"fe00000100", 0x10000, 5},
+		{"feffffffff", 0xffffffff, 5},
+		{"ff0000000001000000", 0x100000000, 9},
+		{"ffffffffffffffffff", 0xffffffffffffffff, 9},
+		{"fc01", 0xfc, 1}, //only the varint is read
+	} {
+		data, _ := hex.DecodeString(c.data)
+		value, advance, err := btc_parse_varint(data)
+		if err != nil || value != c.value || advance != c.advance {
+			t.Errorf("%s parsed as %d (%d bytes, %v)", c.data, value, advance, err)
+		}
+	}
+	for _, c := range []string{"", "fd", "fd01", "fe010000", "ff01020304050607"} {
+		data, _ := hex.DecodeString(c)
+		if _, _, err := btc_parse_varint(data); err == nil {
+			t.Errorf("truncated varint %s was parsed", c)
+		}
+	}
+	for _, value := range []uint64{0, 0xfc, 0xfd, 0xffff, 0x10000, 0xffffffff, 0x100000000, 0xffffffffffffffff} {
+		if parsed, advance, err := btc_parse_varint(btc_encode_varint(value)); err != nil || parsed != value || int(advance) != len(btc_encode_varint(value)) {
+			t.Errorf("%d did not round trip", value)
+		}
+	}
+}
+
+func TestParseTx(t *testing.T) {
+	stripped := test_raw_tx(1, [][32]byte{test_commit(1), test_commit(2)})
+	segwit := test_segwit_tx(stripped)
+
+	for _, raw := range [][]byte{stripped, segwit} {
+		data := append(append([]byte{}, raw...), 0xAA) //whatever comes next is left alone
+		txid, commits, err := btc_parse_tx(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txid != btc_double_sha256(stripped) {
+			t.Errorf("txid %X is not the hash without witnesses", txid)
+		}
+		if len(commits) != 2 || commits[0] != test_commit(1) || commits[1] != test_commit(2) {
+			t.Errorf("found commits %X", commits)
+		}
+		if len(data) != 1 || data[0] != 0xAA {
+			t.Errorf("left %X", data)
+		}
+	}
+
+	//outputs that arent P2WSH are not commits
+	var p2wpkh bytes.Buffer
+	p2wpkh.Write(stripped[:len(stripped)-4-8-1-34-8-1-34-1])
+	p2wpkh.Write(btc_encode_varint(1))
+	binary.Write(&p2wpkh, binary.LittleEndian, uint64(546))
+	p2wpkh.Write(btc_encode_varint(22))
+	p2wpkh.Write([]byte{0x00, 0x14})
+	p2wpkh.Write(make([]byte, 20))
+	p2wpkh.Write(make([]byte, 4))
+	data := p2wpkh.Bytes()
+	if _, commits, err := btc_parse_tx(&data); err != nil || len(commits) != 0 {
+		t.Errorf("found commits %X (%v)", commits, err)
+	}
+
+	for i := 0; i < len(segwit); i++ {
+		data := append([]byte{}, segwit[:i]...)
+		if _, _, err := btc_parse_tx(&data); err == nil {
+			t.Fatalf("tx truncated to %d bytes was parsed", i)
+		}
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	var block BlockData
+	genesis, _ := hex.DecodeString(TEST_GENESIS_BLOCK)
+	if err := btc_parse_block(genesis, &block); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%X", block.Hash) != TEST_GENESIS_HASH || block.Previous != [32]byte{} || len(block.Commits) != 0 {
+		t.Fatalf("genesis parsed as %X", block.Hash)
+	}
+
+	//the merkle root covers txids, so a block with witnesses has the same header as one without
+	test_setup(t)
+	coinbase := test_raw_tx(1000, nil)
+	stripped := test_raw_tx(1001, [][32]byte{test_commit(1), test_commit(2)})
+	raw := test_raw_block(COMBInfo.Hash, coinbase, stripped)
+	raw = append(raw[:len(raw)-len(stripped)], test_segwit_tx(stripped)...)
+	block = BlockData{}
+	if err := btc_parse_block(raw, &block); err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Commits) != 2 || block.Commits[1] != test_commit(2) {
+		t.Fatalf("found commits %X", block.Commits)
+	}
+
+	var commit [32]byte = test_commit(2)
+	var changed []byte = append([]byte{}, raw...)
+	changed[bytes.Index(changed, commit[:])+31] ^= 1
+	for _, c := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"truncated", raw[:len(raw)-1]},
+		{"trailing data", append(append([]byte{}, raw...), 0)},
+		{"header only", raw[:80]},
+		{"huge tx count", append(append([]byte{}, raw[:80]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)},
+		{"changed commit", changed},
+	} {
+		if err := btc_parse_block(c.raw, &BlockData{}); err == nil {
+			t.Errorf("%s block was parsed", c.name)
+		}
+	}
+}
+
+func FuzzParseBlock(f *testing.F) {
+	test_setup(f) //regtest, so the seed blocks can be mined
+	genesis, _ := hex.DecodeString(TEST_GENESIS_BLOCK)
+	stripped := test_raw_tx(1, [][32]byte{test_commit(1)})
+	f.Add(genesis)
+	f.Add(test_raw_block([32]byte{}, test_raw_tx(0, nil), stripped))
+	f.Add(append(test_raw_block([32]byte{}, stripped)[:81], test_segwit_tx(stripped)...))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		//anything goes in, errors come out, never a panic or a block that doesnt match its data
+		var block BlockData
+		if err := btc_parse_block(raw, &block); err != nil {
+			return
+		}
+		var header [80]byte
+		copy(header[:], raw[0:80])
+		if hash, previous := btc_parse_header(header); block.Header != header || block.Hash != hash || block.Previous != previous {
+			t.Fatalf("block %X does not match its header", block.Hash)
+		}
+		if len(block.Commits)*34 > len(raw) {
+			t.Fatalf("%d commits in %d bytes", len(block.Commits), len(raw))
+		}
+	})
+}
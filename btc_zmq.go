@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const ZMQ_MAX_FRAME = 32 * 1024 * 1024
+
+var ZMQInfo struct {
+	Enabled bool
+	Wake    chan struct{}
+	Blocks  chan BlockData
+}
+
+func zmq_init() {
+	//blocks arrive through bitcoin cores zmqpubhashblock/zmqpubrawblock, polling stays as the fallback
+	ZMQInfo.Enabled = *btc_zmq != "" && BTCInfo.Enabled
+	if !ZMQInfo.Enabled {
+		return
+	}
+	ZMQInfo.Wake = make(chan struct{}, 1)
+	ZMQInfo.Blocks = make(chan BlockData, 16)
+
+	for _, endpoint := range strings.Split(*btc_zmq, ",") {
+		address := strings.TrimPrefix(strings.TrimSpace(endpoint), "tcp://")
+		log_status("zmq", "subscribing to %s", address)
+		go zmq_subscribe(address)
+	}
+}
+
+func zmq_write_frame(conn net.Conn, flags byte, body []byte) (err error) {
+	//flags(1), size(1 or 8), body(var)
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | 0x02
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	_, err = conn.Write(append(header, body...))
+	return err
+}
+
+func zmq_read_frame(conn net.Conn) (flags byte, body []byte, err error) {
+	var size uint64
+	var header [8]byte
+	if _, err = io.ReadFull(conn, header[:1]); err != nil {
+		return 0, nil, err
+	}
+	flags = header[0]
+	if flags&0x02 != 0 { //long frame
+		if _, err = io.ReadFull(conn, header[:8]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(header[:8])
+	} else {
+		if _, err = io.ReadFull(conn, header[:1]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(header[0])
+	}
+	if size > ZMQ_MAX_FRAME {
+		return 0, nil, fmt.Errorf("frame too large (%d bytes)", size)
+	}
+	body = make([]byte, size)
+	if _, err = io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+func zmq_read_message(conn net.Conn) (parts [][]byte, err error) {
+	//a message is a run of frames with the more flag set on all but the last
+	for {
+		flags, body, err := zmq_read_frame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if flags&0x04 != 0 {
+			continue //command, nothing we need after the handshake
+		}
+		parts = append(parts, body)
+		if flags&0x01 == 0 {
+			return parts, nil
+		}
+	}
+}
+
+func zmq_connect(address string) (conn net.Conn, err error) {
+	//ZMTP 3.0 with the NULL mechanism. see https://rfc.zeromq.org/spec/23/
+	if conn, err = net.DialTimeout("tcp", address, time.Second*10); err != nil {
+		return nil, err
+	}
+
+	var greeting [64]byte
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3 //version 3.0
+	copy(greeting[12:32], "NULL")
+	if _, err = conn.Write(greeting[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, greeting[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if greeting[0] != 0xff || greeting[9] != 0x7f || greeting[10] < 3 {
+		conn.Close()
+		return nil, fmt.Errorf("not a zmq publisher")
+	}
+
+	//READY command with our socket type
+	var ready bytes.Buffer
+	ready.WriteByte(5)
+	ready.WriteString("READY")
+	ready.WriteByte(11)
+	ready.WriteString("Socket-Type")
+	binary.Write(&ready, binary.BigEndian, uint32(3))
+	ready.WriteString("SUB")
+	if err = zmq_write_frame(conn, 0x04, ready.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if flags, _, err := zmq_read_frame(conn); err != nil || flags&0x04 == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("publisher did not send READY")
+	}
+
+	//in ZMTP 3.0 a subscription is a message starting with 1
+	for _, topic := range []string{"hashblock", "rawblock"} {
+		if err = zmq_write_frame(conn, 0x00, append([]byte{1}, topic...)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func zmq_subscribe(address string) {
+	for {
+		conn, err := zmq_connect(address)
+		if err != nil {
+			log_error("zmq", "cannot connect to %s (%s)", address, err.Error())
+			time.Sleep(time.Second * 10)
+			continue
+		}
+		log_status("zmq", "connected to %s", address)
+
+		for {
+			var parts [][]byte
+			if parts, err = zmq_read_message(conn); err != nil {
+				log_error("zmq", "lost %s (%s)", address, err.Error())
+				break
+			}
+			zmq_handle_message(parts)
+		}
+		conn.Close()
+		time.Sleep(time.Second * 10)
+	}
+}
+
+func zmq_handle_message(parts [][]byte) {
+	//topic, body, sequence
+	if len(parts) < 2 {
+		return
+	}
+	switch string(parts[0]) {
+	case "rawblock":
+		block := new(BlockData)
+		if err := btc_parse_block(parts[1], block); err != nil {
+			log_error("zmq", "bad raw block (%s)", err.Error())
+			break
+		}
+		select {
+		case ZMQInfo.Blocks <- *block:
+			return
+		default: //main loop is busy, it will sync normally
+		}
+	case "hashblock":
+		log_info("zmq", "new block %X", parts[1])
+	default:
+		return
+	}
+	select {
+	case ZMQInfo.Wake <- struct{}{}:
+	default:
+	}
+}
+
+func zmq_ingest(block BlockData) {
+	//a raw block that extends our tip can go straight into ingest, anything else is left to btc_sync
+	//only btc_sync holds blocks back for confirmations, cross checks sources and refuses a mismatched one
+	if *btc_min_confirmations != 0 || *btc_cross_check {
+		return
+	}
+	BTCInfo.Guard.RLock()
+	var mismatch bool = BTCInfo.Mismatch != ""
+	BTCInfo.Guard.RUnlock()
+	if mismatch {
+		return
+	}
+	COMBInfo.Guard.RLock()
+	var extends bool = block.Previous == COMBInfo.Hash
+	COMBInfo.Guard.RUnlock()
+	if !extends {
+		return
+	}
+	if !IngestInfo.Guard.TryLock() {
+		return //btc_sync (or a push or an import) is busy, it picks the block up
+	}
+	defer IngestInfo.Guard.Unlock()
+	if err := ingest_process_block(block); err != nil {
+		log_error("zmq", "block rejected (%s)", err.Error())
+		return
+	}
+	ingest_write()
+}
+
+func btc_wait(timeout time.Duration) {
+	//sleep until the next poll, or until zmq tells us about a new block
+	if !ZMQInfo.Enabled {
+		time.Sleep(timeout)
+		return
+	}
+	select {
+	case block := <-ZMQInfo.Blocks:
+		zmq_ingest(block)
+	case <-ZMQInfo.Wake:
+		//hashblock comes before rawblock, give the raw block a moment so we dont fetch it over REST
+		select {
+		case block := <-ZMQInfo.Blocks:
+			zmq_ingest(block)
+		case <-time.After(time.Second):
+		}
+	case <-time.After(timeout):
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// a bitcoind zmq publisher on localhost, sends messages once a subscriber has finished the handshake
+func test_zmq_publisher(t testing.TB, messages ...[][]byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var greeting [64]byte
+		if _, err = io.ReadFull(conn, greeting[:]); err != nil {
+			return
+		}
+		conn.Write(greeting[:]) //same version and mechanism
+		if flags, _, err := zmq_read_frame(conn); err != nil || flags&0x04 == 0 {
+			return
+		}
+		zmq_write_frame(conn, 0x04, []byte("\x05READY"))
+		for i := 0; i < 2; i++ {
+			if _, body, err := zmq_read_frame(conn); err != nil || body[0] != 1 {
+				return
+			}
+		}
+
+		for _, message := range messages {
+			zmq_write_frame(conn, 0x04, []byte("\x04PING")) //commands can come between messages
+			for i, part := range message {
+				var flags byte
+				if i != len(message)-1 {
+					flags = 0x01
+				}
+				zmq_write_frame(conn, flags, part)
+			}
+		}
+		time.Sleep(time.Second)
+	}()
+	return listener.Addr().String()
+}
+
+func TestZMQ(t *testing.T) {
+	test_setup(t)
+	ZMQInfo.Wake = make(chan struct{}, 1)
+	ZMQInfo.Blocks = make(chan BlockData, 16)
+
+	//big enough for a long frame
+	var commits [][32]byte
+	for i := 0; i < 20; i++ {
+		commits = append(commits, test_commit(i))
+	}
+	raw := test_raw_block(COMBInfo.Hash, test_raw_tx(1, commits))
+	var block BlockData
+	btc_parse_block(raw, &block)
+
+	address := test_zmq_publisher(t,
+		[][]byte{[]byte("hashblock"), block.Hash[:], {0, 0, 0, 0}},
+		[][]byte{[]byte("rawblock"), raw, {0, 0, 0, 0}})
+	conn, err := zmq_connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	parts, err := zmq_read_message(conn)
+	if err != nil || len(parts) != 3 || string(parts[0]) != "hashblock" || string(parts[1]) != string(block.Hash[:]) {
+		t.Fatalf("read %q (%v)", parts, err)
+	}
+	zmq_handle_message(parts)
+	select {
+	case <-ZMQInfo.Wake:
+	default:
+		t.Fatal("hashblock did not wake the main loop")
+	}
+
+	if parts, err = zmq_read_message(conn); err != nil || len(parts) != 3 || string(parts[1]) != string(raw) {
+		t.Fatalf("read %d parts (%v)", len(parts), err)
+	}
+	zmq_handle_message(parts)
+	var received BlockData
+	select {
+	case received = <-ZMQInfo.Blocks:
+	default:
+		t.Fatal("rawblock was not passed on")
+	}
+	if received.Hash != block.Hash || len(received.Commits) != 20 {
+		t.Fatalf("received %X", received.Hash)
+	}
+
+	//only ingested directly when btc_sync wouldnt do anything more with it
+	flag.Set("btc_cross_check", "true")
+	zmq_ingest(received)
+	flag.Set("btc_cross_check", "false")
+	BTCInfo.Mismatch = "wrong network"
+	zmq_ingest(received)
+	BTCInfo.Mismatch = ""
+	if COMBInfo.Hash == block.Hash {
+		t.Fatal("block skipped the checks in btc_sync")
+	}
+	zmq_ingest(received)
+	if COMBInfo.Hash != block.Hash {
+		t.Fatal("block was not ingested")
+	}
+}
+
+func TestZMQNotPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Write(make([]byte, 64))
+			conn.Close()
+		}
+	}()
+	if _, err = zmq_connect(listener.Addr().String()); err == nil {
+		t.Fatal("connected to something that isnt a publisher")
+	}
+}
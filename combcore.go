@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"libcomb"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -17,13 +21,21 @@ var shutdown sync.Mutex
 var COMBInfo struct {
 	Height uint64
 	Hash   [32]byte
+	Header [80]byte              //header of the top block, zero if unknown
 	Chain  map[[32]byte][32]byte //child -> parent
 
+	Checkpoint       [32]byte //first block of our chain, every peer on our network has it
+	CheckpointHeight uint64
+	CheckpointHeader [80]byte //needed to check the block after it, zero until known on networks that dont have it built in
+
 	Network string
 	Magic   uint32
 	Prefix  map[string]string
 	Path    string
 
+	PowLimit    [32]byte
+	PowRetarget bool //difficulty follows on from the parent, not true on testnet (min difficulty blocks)
+
 	Guard sync.RWMutex
 }
 
@@ -43,12 +55,14 @@ func setup_graceful_shutdown() {
 	shutdown.Lock()
 }
 
-func combcore_init() {
+func combcore_parse_flags() {
 	iniflags.SetAllowMissingConfigFile(false)
 	iniflags.SetAllowUnknownFlags(false)
 	iniflags.SetConfigFile("config.ini")
 	iniflags.Parse()
+}
 
+func combcore_init() {
 	//reset to known empty state
 	libcomb.Reset()
 
@@ -57,6 +71,137 @@ func combcore_init() {
 	setup_graceful_shutdown()
 }
 
+func combcore_command(args []string) (err error) {
+	//offline commands, run instead of the node: combcore [flags] <command> [args]
+	ingest_init()
+	if err = db_open(); err != nil {
+		return fmt.Errorf("failed to open db (%s)", err.Error())
+	}
+	if args[0] == "import" {
+		db_start() //only import needs the chain loaded, the rest look at the db as it is (loading it could start a repair)
+	}
+
+	switch args[0] {
+	case "check-db":
+		err = combcore_check_db(args[1:])
+	case "export", "import":
+		if len(args) != 2 {
+			err = fmt.Errorf("usage: combcore %s <file>", args[0])
+			break
+		}
+		if args[0] == "export" {
+			if err = combcore_check_version(); err == nil {
+				_, _, err = bootstrap_export(args[1])
+			}
+		} else {
+			_, err = bootstrap_import(args[1])
+		}
+	default:
+		err = fmt.Errorf("unknown command %s", args[0])
+	}
+
+	critical.Lock()
+	db_close()
+	critical.Unlock()
+	return err
+}
+
+func combcore_check_version() error {
+	//commands that dont load the db cant migrate it either
+	if version := db_get_version(); version != DB_CURRENT_VERSION && !db_is_new {
+		return fmt.Errorf("database is version %d, start combcore once to migrate it", version)
+	}
+	return nil
+}
+
+func combcore_check_db(args []string) (err error) {
+	//prints a JSON report to stdout, main already sent logging to the log file so the output stays machine readable
+	var repair bool
+	for _, arg := range args {
+		switch arg {
+		case "--repair", "-repair":
+			repair = true
+		default:
+			return fmt.Errorf("usage: combcore check-db [--repair]")
+		}
+	}
+
+	if err = combcore_check_version(); err != nil {
+		return err
+	}
+	report := db_check()
+	if repair {
+		if err = db_check_truncate(&report); err != nil {
+			return err
+		}
+	}
+
+	var out []byte
+	if out, err = json.MarshalIndent(report, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	if len(report.Issues) != 0 && !report.Repaired {
+		return fmt.Errorf("%d issues found", len(report.Issues))
+	}
+	return nil
+}
+
+func combcore_set_prefix(style string) (err error) {
+	//wallet construct prefixes, mainnet uses unix style paths and testnet uses windows style paths
+	var prefixes = map[string]string{
+		"stack":           "/stack/data/",
+		"tx":              "/tx/recv/",
+		"key":             "/wallet/data/",
+		"merkle":          "/merkle/data/",
+		"unsigned_merkle": "/contract/data/",
+		"decider":         "/purse/data/",
+	}
+	for name, prefix := range prefixes {
+		switch style {
+		case "unix":
+			COMBInfo.Prefix[name] = prefix
+		case "windows":
+			COMBInfo.Prefix[name] = strings.ReplaceAll(prefix, "/", "\\")
+		default:
+			return fmt.Errorf("unknown prefix style %s", style)
+		}
+	}
+	return nil
+}
+
+func combcore_set_custom_network() (err error) {
+	//a network defined entirely in config.ini
+	var magic []byte
+	if COMBInfo.Hash, err = parse_hex(*comb_custom_hash); err != nil {
+		return fmt.Errorf("bad checkpoint hash (%s)", err.Error())
+	}
+	if len(*comb_custom_magic) != 8 || !checkHEX(strings.ToUpper(*comb_custom_magic), 4) {
+		return fmt.Errorf("magic must be 4 hex bytes as they appear on the wire")
+	}
+	magic = hex2byte([]byte(strings.ToUpper(*comb_custom_magic)))
+	if COMBInfo.PowLimit, err = parse_hex(*comb_custom_pow_limit); err != nil {
+		return fmt.Errorf("bad pow limit (%s)", err.Error())
+	}
+	if err = combcore_set_prefix(*comb_custom_prefix); err != nil {
+		return err
+	}
+	switch *comb_custom_rules {
+	case "mainnet":
+	case "testnet":
+		libcomb.SwitchToTestnet()
+	default:
+		return fmt.Errorf("unknown rules %s", *comb_custom_rules)
+	}
+
+	COMBInfo.Height = *comb_custom_height
+	COMBInfo.Magic = binary.LittleEndian.Uint32(magic)
+	COMBInfo.Path = *comb_custom_path
+	COMBInfo.PowRetarget = *comb_custom_pow_retarget
+	return nil
+}
+
 func combcore_set_network() {
 	COMBInfo.Guard.Lock()
 	defer COMBInfo.Guard.Unlock()
@@ -65,6 +210,7 @@ func combcore_set_network() {
 	COMBInfo.Chain = make(map[[32]byte][32]byte)
 
 	COMBInfo.Network = *comb_network
+	COMBInfo.CheckpointHeader = [80]byte{}
 
 	log_status("combcore", "loading in %s mode", COMBInfo.Network)
 
@@ -75,30 +221,90 @@ func combcore_set_network() {
 		COMBInfo.Hash, _ = parse_hex("0000000000000000003bec88b7ba0bebd8eb3b1c1c599e44a2b270ad3e8203ca")
 		COMBInfo.Magic = binary.LittleEndian.Uint32([]byte{0xf9, 0xbe, 0xb4, 0xd9})
 		COMBInfo.Path = "commits"
-		COMBInfo.Prefix["stack"] = "/stack/data/"
-		COMBInfo.Prefix["tx"] = "/tx/recv/"
-		COMBInfo.Prefix["key"] = "/wallet/data/"
-		COMBInfo.Prefix["merkle"] = "/merkle/data/"
-		COMBInfo.Prefix["unsigned_merkle"] = "/contract/data/"
-		COMBInfo.Prefix["decider"] = "/purse/data/"
+		//the header of block 481822 isnt built in, its fetched from the BTC peer once (see combcore_set_checkpoint_header)
+		COMBInfo.PowLimit, _ = parse_hex("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+		COMBInfo.PowRetarget = true
+		combcore_set_prefix("unix")
 	case "testnet":
 		COMBInfo.Height = 0
 		COMBInfo.Hash, _ = parse_hex("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
 		COMBInfo.Magic = binary.LittleEndian.Uint32([]byte{0x0B, 0x11, 0x09, 0x07})
 		COMBInfo.Path = "commits_testnet"
-		COMBInfo.Prefix["stack"] = "\\stack\\data\\"
-		COMBInfo.Prefix["tx"] = "\\tx\\recv\\"
-		COMBInfo.Prefix["key"] = "\\wallet\\data\\"
-		COMBInfo.Prefix["merkle"] = "\\merkle\\data\\"
-		COMBInfo.Prefix["unsigned_merkle"] = "\\contract\\data\\"
-		COMBInfo.Prefix["decider"] = "\\purse\\data\\"
+		COMBInfo.CheckpointHeader = combcore_parse_header("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4adae5494dffff001d1aa4ae18") //genesis
+		COMBInfo.PowLimit, _ = parse_hex("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+		COMBInfo.PowRetarget = false
+		combcore_set_prefix("windows")
+		libcomb.SwitchToTestnet()
+	case "regtest":
+		COMBInfo.Height = 0
+		COMBInfo.Hash, _ = parse_hex("0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206")
+		COMBInfo.Magic = binary.LittleEndian.Uint32([]byte{0xfa, 0xbf, 0xb5, 0xda})
+		COMBInfo.Path = "commits_regtest"
+		COMBInfo.CheckpointHeader = combcore_parse_header("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4adae5494dffff7f2002000000") //genesis
+		COMBInfo.PowLimit, _ = parse_hex("7fffff0000000000000000000000000000000000000000000000000000000000")
+		COMBInfo.PowRetarget = false
+		combcore_set_prefix("windows")
+		libcomb.SwitchToTestnet()
+	case "signet":
+		COMBInfo.Height = 0
+		COMBInfo.Hash, _ = parse_hex("00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6")
+		COMBInfo.Magic = binary.LittleEndian.Uint32([]byte{0x0a, 0x03, 0xcf, 0x40})
+		COMBInfo.Path = "commits_signet"
+		COMBInfo.CheckpointHeader = combcore_parse_header("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a008f4d5fae77031e8ad22203") //genesis
+		COMBInfo.PowLimit, _ = parse_hex("00000377ae000000000000000000000000000000000000000000000000000000")
+		COMBInfo.PowRetarget = true
+		combcore_set_prefix("windows")
 		libcomb.SwitchToTestnet()
+	case "custom":
+		if err := combcore_set_custom_network(); err != nil {
+			log_panic("combcore", "custom network is misconfigured (%s)", err.Error())
+			os.Exit(-1)
+		}
 	default:
 		log_panic("combcore", "unknown network %s", COMBInfo.Network)
+		os.Exit(-1)
 	}
 
 	libcomb.SetHeight(COMBInfo.Height)
 	COMBInfo.Chain[COMBInfo.Hash] = [32]byte{}
+	COMBInfo.Checkpoint = COMBInfo.Hash
+	COMBInfo.CheckpointHeight = COMBInfo.Height
+	COMBInfo.Header = COMBInfo.CheckpointHeader
+}
+
+func combcore_parse_header(data string) (header [80]byte) {
+	//only for headers built into the binary, anything wrong is a bug
+	raw, err := hex.DecodeString(data)
+	if err != nil || len(raw) != 80 {
+		log_panic("combcore", "built in header is malformed")
+		os.Exit(-1)
+	}
+	copy(header[:], raw)
+	return header
+}
+
+func combcore_set_checkpoint_header(header [80]byte) (err error) {
+	//the checkpoint hash proves the header, so it can come from anywhere. its stored so its only needed once
+	COMBInfo.Guard.Lock()
+	defer COMBInfo.Guard.Unlock()
+	if COMBInfo.CheckpointHeader != [80]byte{} {
+		return nil
+	}
+	if hash, _ := btc_parse_header(header); hash != COMBInfo.Checkpoint {
+		return fmt.Errorf("header %X is not the checkpoint %X", hash, COMBInfo.Checkpoint)
+	}
+
+	batch := new(StorageBatch)
+	db_put_meta(batch, DB_META_CHECKPOINT_HEADER, header[:])
+	if err = db_write(batch); err != nil {
+		return err
+	}
+	COMBInfo.CheckpointHeader = header
+	if COMBInfo.Hash == COMBInfo.Checkpoint {
+		COMBInfo.Header = header
+	}
+	log_status("combcore", "checkpoint header is now known")
+	return nil
 }
 
 func combcore_process_block(block Block) (err error) {
@@ -132,31 +338,47 @@ func combcore_process_block(block Block) (err error) {
 	}
 	COMBInfo.Chain[block.Metadata.Hash] = COMBInfo.Hash
 	COMBInfo.Hash = block.Metadata.Hash
+	COMBInfo.Header = block.Metadata.Header
 	return nil
 }
 
-func combcore_reorg(target [32]byte) {
+func combcore_reorg(target [32]byte) (err error) {
 	COMBInfo.Guard.Lock()
 	defer COMBInfo.Guard.Unlock()
 
 	//target is the highest common block between our chain and the new reorged chain
 	//this function should remove all block data after target, and rollback libcomb to target
+	//nothing is changed unless the rollback can be queued, otherwise libcomb and the db would disagree
 	var ok bool
-	var metadata = db_get_block_metadata_by_hash(target)
+	var metadata BlockMetadata
+	if target == COMBInfo.Checkpoint {
+		metadata.Hash = target
+		metadata.Height = COMBInfo.CheckpointHeight
+		metadata.Header = COMBInfo.CheckpointHeader
+	} else if metadata = db_get_block_metadata_by_hash(target); metadata.Hash != target {
+		return fmt.Errorf("block %X is not stored", target)
+	}
 
 	log_status("combcore", "reorg encountered, rolling back to block %d", metadata.Height)
 
 	log_status("combcore", "tracing back...")
 	//trace back our in-memory chain
-	for COMBInfo.Hash != target {
-		if COMBInfo.Hash, ok = COMBInfo.Chain[COMBInfo.Hash]; !ok {
-			log_panic("combcore", "reorg past checkpoint is not possible")
+	var hash [32]byte = COMBInfo.Hash
+	for hash != target {
+		if hash, ok = COMBInfo.Chain[hash]; !ok || hash == [32]byte{} {
+			return fmt.Errorf("reorg past checkpoint is not possible")
 		}
 	}
 
 	log_status("combcore", "removing blocks from database...")
-	//remove reorg'd blocks from the db
-	db_remove_blocks_after(metadata.Height + 1)
+	//remove reorg'd blocks from the db, this goes in the ingest batch so its written in one go with the blocks replacing them
+	//a crash before then leaves the db on the old chain, never part way between the two
+	var batch *StorageBatch = new(StorageBatch)
+	if err = db_remove_blocks_after(batch, metadata.Height+1); err != nil {
+		return fmt.Errorf("cannot remove blocks (%s)", err.Error())
+	}
+	IngestInfo.Batch.Append(batch)
+	COMBInfo.Hash = target
 
 	log_status("combcore", "unloading blocks...")
 	//unload libcomb to the target height
@@ -167,5 +389,8 @@ func combcore_reorg(target [32]byte) {
 	libcomb.FinishReorg()
 	libcomb.ReleaseLock()
 
+	COMBInfo.Header = metadata.Header
+
 	log_status("combcore", "finished at %X (%d)", COMBInfo.Hash, COMBInfo.Height)
+	return nil
 }
@@ -8,10 +8,35 @@ var (
 	btc_peer = flag.String("btc_peer", "", "")
 	btc_port = flag.Uint("btc_port", 8332, "")
 	btc_data = flag.String("btc_data", "", "")
+	btc_p2p  = flag.String("btc_p2p", "", "")
+	btc_zmq  = flag.String("btc_zmq", "", "")
 
-	comb_host    = flag.String("comb_host", "127.0.0.1", "")
-	comb_port    = flag.Uint("comb_port", 2211, "")
-	comb_network = flag.String("comb_network", "mainnet", "")
+	btc_cross_check = flag.Bool("btc_cross_check", false, "")
+	btc_mempool     = flag.Bool("btc_mempool", false, "")
+
+	btc_rest_workers = flag.Uint("btc_rest_workers", 4, "")
+	btc_rest_timeout = flag.Uint("btc_rest_timeout", 30, "")
+	btc_rest_retries = flag.Uint("btc_rest_retries", 5, "")
+
+	btc_min_confirmations = flag.Uint("btc_min_confirmations", 0, "")
+
+	btc_direct_workers = flag.Uint("btc_direct_workers", 0, "")  //0 means one per CPU
+	btc_direct_memory  = flag.Uint("btc_direct_memory", 256, "") //MB
+
+	comb_host      = flag.String("comb_host", "127.0.0.1", "")
+	comb_port      = flag.Uint("comb_port", 2211, "")
+	comb_network   = flag.String("comb_network", "mainnet", "")
+	comb_db_engine = flag.String("comb_db_engine", "leveldb", "")
+
+	//only used when comb_network = custom
+	comb_custom_height       = flag.Uint64("comb_custom_height", 0, "")
+	comb_custom_hash         = flag.String("comb_custom_hash", "", "")
+	comb_custom_magic        = flag.String("comb_custom_magic", "", "")
+	comb_custom_path         = flag.String("comb_custom_path", "commits_custom", "")
+	comb_custom_prefix       = flag.String("comb_custom_prefix", "windows", "")
+	comb_custom_rules        = flag.String("comb_custom_rules", "testnet", "")
+	comb_custom_pow_limit    = flag.String("comb_custom_pow_limit", "7fffff0000000000000000000000000000000000000000000000000000000000", "")
+	comb_custom_pow_retarget = flag.Bool("comb_custom_pow_retarget", false, "")
 
 	push_ip   = flag.String("push_client_ip", "", "")
 	push_port = flag.Uint("push_client_port", 2211, "")
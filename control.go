@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"sync"
@@ -337,6 +338,41 @@ func (c *Control) CheckAddresses(args *[]string, reply *[]string) (err error) {
 	return nil
 }
 
+func (c *Control) CheckMempool(args *string, reply *bool) (err error) {
+	//is the commitment of this address waiting in the mempool
+	var address [32]byte
+	if !MempoolInfo.Enabled {
+		return fmt.Errorf("mempool watcher is disabled")
+	}
+	if address, err = parse_hex(*args); err != nil {
+		return err
+	}
+	*reply = mempool_have_commit(libcomb.Commit(address))
+	return nil
+}
+
+type AddressCheckReply struct {
+	Address string
+	Pending bool //commitment is in the mempool
+}
+
+func (c *Control) CheckAddressesPending(args *[]string, reply *[]AddressCheckReply) (err error) {
+	//same as CheckAddresses, but flags the addresses whose commitment is already in the mempool
+	var address [32]byte
+
+	*reply = make([]AddressCheckReply, 0)
+	for _, a := range *args {
+		if address, err = parse_hex(a); err != nil {
+			return err
+		}
+		address = libcomb.Commit(address)
+		if !libcomb.HaveCommit(address) {
+			*reply = append(*reply, AddressCheckReply{a, MempoolInfo.Enabled && mempool_have_commit(address)})
+		}
+	}
+	return nil
+}
+
 func (c *Control) GetCOMBBase(args *int, reply *string) (err error) {
 	var height uint64 = uint64(*args)
 	var combbase [32]byte
@@ -399,9 +435,47 @@ type StatusReply struct {
 	COMBHeight     uint64
 	BTCHeight      uint64
 	BTCKnownHeight uint64
+	PendingBlocks  uint64
 	Commits        uint64
 	Status         string
 	Network        string
+	Mismatch       string //set when the BTC peer is on a different network, nothing is mined until its fixed
+	Degraded       bool   //corrupted blocks were dropped and are being mined again
+	RepairHeight   uint64
+}
+
+func (c *Control) GetBlockByHash(args *string, reply *BlockReply) (err error) {
+	var hash [32]byte
+	if hash, err = parse_hex(*args); err != nil {
+		return err
+	}
+	var metadata BlockMetadata = db_get_block_metadata_by_hash(hash)
+	if metadata.Hash != hash {
+		return fmt.Errorf("block not found")
+	}
+	reply.Hash = stringify_hex(metadata.Hash)
+	reply.Height = int(metadata.Height)
+	return nil
+}
+
+type CommitLocationReply struct {
+	Height    uint64
+	Order     uint32
+	BlockHash string
+}
+
+func (c *Control) FindCommit(args *string, reply *[]CommitLocationReply) (err error) {
+	//every block the commit appears in, only the first occurrence gets the tag
+	var commit [32]byte
+	if commit, err = parse_hex(*args); err != nil {
+		return err
+	}
+	*reply = make([]CommitLocationReply, 0)
+	for _, tag := range db_find_commits(commit) {
+		metadata := db_get_block_metadata_by_height(tag.Height)
+		*reply = append(*reply, CommitLocationReply{tag.Height, tag.Order, stringify_hex(metadata.Hash)})
+	}
+	return nil
 }
 
 func (c *Control) GetStatus(args *struct{}, reply *StatusReply) (err error) {
@@ -413,9 +487,43 @@ func (c *Control) GetStatus(args *struct{}, reply *StatusReply) (err error) {
 	reply.COMBHeight = COMBInfo.Height
 	reply.BTCHeight = BTCInfo.Chain.Height
 	reply.BTCKnownHeight = BTCInfo.Chain.KnownHeight
+	reply.PendingBlocks = uint64(len(BTCInfo.Pending))
 	reply.Commits = libcomb.GetCommitCount()
 	reply.Status = GUIInfo.Status
 	reply.Network = COMBInfo.Network
+	reply.Mismatch = BTCInfo.Mismatch
+	reply.Degraded = DBInfo.RepairHeight != 0
+	reply.RepairHeight = DBInfo.RepairHeight
+	if reply.Mismatch != "" {
+		reply.Status = "Network mismatch"
+	}
+	return nil
+}
+
+type PendingBlockReply struct {
+	Hash     string
+	Previous string
+	Height   uint64
+	Commits  []string
+}
+
+func (c *Control) GetPendingBlocks(args *struct{}, reply *[]PendingBlockReply) (err error) {
+	//blocks held back by btc_min_confirmations, their commits are not loaded into libcomb yet
+	BTCInfo.Guard.RLock()
+	defer BTCInfo.Guard.RUnlock()
+
+	*reply = make([]PendingBlockReply, 0)
+	for i, b := range BTCInfo.Pending {
+		var p PendingBlockReply
+		p.Hash = stringify_hex(b.Hash)
+		p.Previous = stringify_hex(b.Previous)
+		p.Height = BTCInfo.PendingHeight + uint64(i)
+		p.Commits = make([]string, 0)
+		for _, c := range b.Commits {
+			p.Commits = append(p.Commits, stringify_hex(c))
+		}
+		*reply = append(*reply, p)
+	}
 	return nil
 }
 
@@ -424,43 +532,106 @@ func (c *Control) GetFingerprint(args *struct{}, reply *string) (err error) {
 	return nil
 }
 
-type PushBlockArgs struct {
+// the push format before whole blocks were pushed, only kept so old pushing nodes get a clear error
+type PushLegacyBlockArgs struct {
 	Hash     string
 	Previous string
+	Header   string
 	Commits  []string
 }
 
-func (c *Control) PushBlocks(args *[]PushBlockArgs, reply *struct{}) (err error) {
-	//using this function while mining or loading will cause a panic!
+func (c *Control) PushBlocks(args *[]PushLegacyBlockArgs, reply *struct{}) (err error) {
+	//commits without their block cant be checked against the merkle root
+	return fmt.Errorf("blocks without their transactions are not accepted anymore, the pushing node must be upgraded to push version %d", PUSH_VERSION)
+}
+
+type PushBlockArgs struct {
+	Hash  string
+	Block string //the whole block in hex, as bitcoin serializes it
+}
+
+type PushRawBlocksArgs struct {
+	Version          uint16 //PUSH_VERSION, anything else is refused
+	CheckpointHeader string //hex, for clients on networks without it built in. empty if the pusher doesnt know it
+	Blocks           []PushBlockArgs
+}
 
+func (c *Control) PushRawBlocks(args *PushRawBlocksArgs, reply *struct{}) (err error) {
 	if DBInfo.InitialLoad {
 		return fmt.Errorf("cannot push during initial load")
 	}
+	if args.Version != PUSH_VERSION {
+		return fmt.Errorf("push version %d is not supported, expected %d", args.Version, PUSH_VERSION)
+	}
+	if !IngestInfo.Guard.TryLock() {
+		return fmt.Errorf("blocks are being ingested already (mining or an import), try again later")
+	}
+	defer IngestInfo.Guard.Unlock()
+	if args.CheckpointHeader != "" {
+		var raw_header []byte
+		if raw_header, err = hex.DecodeString(args.CheckpointHeader); err != nil || len(raw_header) != 80 {
+			return fmt.Errorf("checkpoint header is malformed")
+		}
+		//checked against the checkpoint hash, does nothing if we know it already
+		if err = combcore_set_checkpoint_header(*(*[80]byte)(raw_header)); err != nil {
+			return err
+		}
+	}
 
-	for _, b := range *args {
+	for _, b := range args.Blocks {
+		var hash [32]byte
+		var raw_data []byte
 		var blk BlockData
-		if blk.Hash, err = parse_hex(b.Hash); err != nil {
+		if hash, err = parse_hex(b.Hash); err != nil {
 			return err
 		}
-		if blk.Previous, err = parse_hex(b.Previous); err != nil {
-			return err
+		if raw_data, err = hex.DecodeString(b.Block); err != nil {
+			return fmt.Errorf("block %s is not hex (%s)", b.Hash, err.Error())
 		}
-
-		blk.Commits = make([][32]byte, 0)
-		for _, c := range b.Commits {
-			if commit, err := parse_hex(c); err == nil {
-				blk.Commits = append(blk.Commits, commit)
-			} else {
-				return err
-			}
+		//parsing checks the commits against the merkle root in the header, ingest checks the header
+		if err = btc_parse_block(raw_data, &blk); err != nil {
+			return fmt.Errorf("block %s is malformed (%s)", b.Hash, err.Error())
+		}
+		if blk.Hash != hash {
+			return fmt.Errorf("block %s is actually %X", b.Hash, blk.Hash)
+		}
+		if err = ingest_process_block(blk); err != nil {
+			ingest_write()
+			return err
 		}
-		ingest_process_block(blk)
 	}
 	ingest_write()
 
 	return nil
 }
 
+type ExportReply struct {
+	Blocks      uint64
+	Fingerprint string
+}
+
+func (c *Control) ExportChain(args *string, reply *ExportReply) (err error) {
+	//write every stored block to a bootstrap file at the given path (on the combcore machine)
+	if DBInfo.InitialLoad {
+		return fmt.Errorf("cannot export during initial load")
+	}
+	var fingerprint [32]byte
+	if reply.Blocks, fingerprint, err = bootstrap_export(*args); err != nil {
+		return err
+	}
+	reply.Fingerprint = stringify_hex(fingerprint)
+	return nil
+}
+
+func (c *Control) ImportChain(args *string, reply *uint64) (err error) {
+	//refused while btc_sync or a push is ingesting
+	if DBInfo.InitialLoad {
+		return fmt.Errorf("cannot import during initial load")
+	}
+	*reply, err = bootstrap_import(*args)
+	return err
+}
+
 func (c *Control) GetChainTip(args *struct{}, reply *string) (err error) {
 	COMBInfo.Guard.RLock()
 	*reply = stringify_hex(COMBInfo.Hash)
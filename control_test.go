@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPushBlocks(t *testing.T) {
+	test_setup(t)
+	var control Control
+
+	var raw [][]byte
+	var previous [32]byte = COMBInfo.Hash
+	for i := 0; i < 3; i++ {
+		test_block_count++
+		raw = append(raw, test_raw_block(previous, test_raw_tx(test_block_count, [][32]byte{test_commit(i)})))
+		hash, _ := btc_parse_header(*(*[80]byte)(raw[i][0:80]))
+		previous = hash
+	}
+	args := func(hash [32]byte, raw []byte) *PushRawBlocksArgs {
+		return &PushRawBlocksArgs{Version: PUSH_VERSION, Blocks: []PushBlockArgs{{Hash: stringify_hex(hash), Block: fmt.Sprintf("%X", raw)}}}
+	}
+	hash_of := func(raw []byte) [32]byte {
+		hash, _ := btc_parse_header(*(*[80]byte)(raw[0:80]))
+		return hash
+	}
+
+	if err := control.PushRawBlocks(args(hash_of(raw[0]), raw[0]), nil); err != nil {
+		t.Fatal(err)
+	}
+	if COMBInfo.Hash != hash_of(raw[0]) {
+		t.Fatal("pushed block was not ingested")
+	}
+
+	//a commit that isnt in the merkle root
+	tampered := append([]byte{}, raw[1]...)
+	tampered[len(tampered)-5] ^= 1
+	if err := control.PushRawBlocks(args(hash_of(raw[1]), tampered), nil); err == nil {
+		t.Fatal("block with a changed commit was accepted")
+	}
+	//a block under the wrong hash
+	if err := control.PushRawBlocks(args(hash_of(raw[2]), raw[1]), nil); err == nil {
+		t.Fatal("block pushed under the wrong hash was accepted")
+	}
+	if COMBInfo.Hash != hash_of(raw[0]) {
+		t.Fatal("rejected block moved the tip")
+	}
+
+	if err := control.PushRawBlocks(args(hash_of(raw[1]), raw[1]), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushVersions(t *testing.T) {
+	//mixed versions fail loudly, never by quietly ingesting nothing
+	test_setup(t)
+	var control Control
+	header := COMBInfo.CheckpointHeader
+	test_forget_checkpoint_header()
+
+	old := &[]PushLegacyBlockArgs{{Hash: stringify_hex(COMBInfo.Hash), Previous: stringify_hex(COMBInfo.Hash)}}
+	if err := control.PushBlocks(old, nil); err == nil {
+		t.Fatal("old push format was accepted")
+	}
+	if err := control.PushRawBlocks(&PushRawBlocksArgs{Version: PUSH_VERSION + 1}, nil); err == nil {
+		t.Fatal("unknown push version was accepted")
+	}
+
+	//the checkpoint header comes along for clients that dont have it
+	args := &PushRawBlocksArgs{Version: PUSH_VERSION, CheckpointHeader: fmt.Sprintf("%X", header[:79])}
+	if err := control.PushRawBlocks(args, nil); err == nil {
+		t.Fatal("short checkpoint header was accepted")
+	}
+	test_block_count++
+	raw := test_raw_block(COMBInfo.Hash, test_raw_tx(test_block_count, [][32]byte{test_commit(0)}))
+	hash, _ := btc_parse_header(*(*[80]byte)(raw[0:80]))
+	args.Blocks = []PushBlockArgs{{Hash: stringify_hex(hash), Block: fmt.Sprintf("%X", raw)}}
+	if err := control.PushRawBlocks(args, nil); err == nil {
+		t.Fatal("block on an unknown checkpoint header was accepted")
+	}
+	args.CheckpointHeader = fmt.Sprintf("%X", header)
+	if err := control.PushRawBlocks(args, nil); err != nil {
+		t.Fatal(err)
+	}
+	if COMBInfo.CheckpointHeader != header || COMBInfo.Hash != hash {
+		t.Fatalf("pushed to %X", COMBInfo.Hash)
+	}
+}
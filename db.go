@@ -1,27 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"hash"
+	"os"
 	"sync"
 
 	"libcomb"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const DB_LEGACY_VERSION = 1
-const DB_CURRENT_VERSION = 2
+const DB_CURRENT_VERSION = 4
 
 const DB_VERSION_KEY_LENGTH = 2
 const DB_BLOCK_KEY_LENGTH = 8
 const DB_COMMIT_KEY_LENGTH = 16
+const DB_META_KEY_LENGTH = 9
+
+// how many writes a migration puts in one batch, a var so tests can make it small
+var DB_MIGRATE_BATCH = 100000
+
+// meta keys sort after every block (height 0xFFFFFFFFFFFFFFFF is never used)
+const DB_META_DIRECT_CURSOR = 'd'
+const DB_META_HASH_INDEX = 'h'        //followed by the block hash, value is the height
+const DB_META_COMMIT_INDEX = 'c'      //followed by the commit and its tag key, no value
+const DB_META_REPAIR = 'r'            //height we need to mine back up to after corruption
+const DB_META_CHECKPOINT_HEADER = 'k' //header of the checkpoint, on networks that dont have it built in
 
-var db *leveldb.DB
+var db Storage
 var db_is_new bool
 var db_mutex sync.Mutex
 
@@ -29,6 +37,9 @@ var DBInfo struct {
 	InitialLoad     bool
 	Version         uint16
 	CorruptedBlocks map[uint64]struct{}
+	RepairHeight    uint64 //the db is missing blocks up to here after being truncated, 0 if its complete
+	MissingHeaders  uint64 //blocks stored before headers were kept, btc_fill_headers gets them from our peer
+	MissingFrom     uint64 //lowest of those
 	Fingerprint     [32]byte
 }
 
@@ -37,6 +48,7 @@ type BlockMetadata struct {
 	Hash        [32]byte
 	Previous    [32]byte
 	Fingerprint [32]byte
+	Header      [80]byte //zero for blocks stored before headers were kept
 }
 
 type Block struct {
@@ -59,7 +71,7 @@ func db_compute_block_fingerprint(commits [][32]byte) [32]byte {
 
 func db_compute_db_fingerprint() [32]byte {
 	var fingerprint [32]byte
-	iter := db.NewIterator(nil, nil)
+	iter := db.NewIterator(nil)
 	var key []byte
 	var value []byte
 	var metadata BlockMetadata
@@ -75,20 +87,16 @@ func db_compute_db_fingerprint() [32]byte {
 	return fingerprint
 }
 
-func db_find_commits(commit [32]byte) (out []uint64) {
-	var tmp [32]byte
-	var height uint64 = 0
-	iter := db.NewIterator(nil, nil)
-	for iok := iter.First(); iok; iok = iter.Next() {
-		if len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
-			height = binary.BigEndian.Uint64(iter.Key())
-		}
-		if len(iter.Key()) == DB_COMMIT_KEY_LENGTH {
-			copy(tmp[:], iter.Value()[0:32])
-			if tmp == commit {
-				out = append(out, height)
-			}
+func db_find_commits(commit [32]byte) (out []libcomb.Tag) {
+	//every place the commit was stored, duplicates included
+	prefix := db_commit_key(commit, nil)
+	iter := db.NewIterator(storage_prefix(prefix[:41]))
+	for iter.Next() {
+		//removing a corrupted block removes the index of what it holds now, not of what it held
+		if value, err := db.Get(iter.Key()[41:57]); err != nil || !bytes.Equal(value, commit[:]) {
+			continue
 		}
+		out = append(out, decode_tag(iter.Key()[41:57]))
 	}
 	iter.Release()
 	return out
@@ -97,30 +105,21 @@ func db_find_commits(commit [32]byte) (out []uint64) {
 func db_open() (err error) {
 	DBInfo.InitialLoad = true
 
-	var lvldb *leveldb.DB
-	var options opt.Options
-	options.Compression = opt.NoCompression
-
+	var storage Storage
 	path := COMBInfo.Path
 
-	//see if a db exists
-	options.ErrorIfMissing = true
-	lvldb, err = leveldb.OpenFile(path, &options)
-
-	if err != nil {
-		options.ErrorIfMissing = false
-		//may not exist, try create one
-		lvldb, err = leveldb.OpenFile(path, &options)
-		if err == nil {
-			db_is_new = true
-		} else {
-			//actually was some other error
+	if *comb_db_engine == "leveldb" {
+		if err = db_finish_migration(path); err != nil {
 			return err
 		}
 	}
 
+	if storage, db_is_new, err = storage_open(*comb_db_engine, path); err != nil {
+		return err
+	}
+
 	db_mutex.Lock()
-	db = lvldb
+	db = storage
 	return nil
 }
 
@@ -130,11 +129,9 @@ func db_close() {
 	db_mutex.Unlock()
 }
 
-func db_write(batch *leveldb.Batch) (err error) {
+func db_write(batch *StorageBatch) (err error) {
 	critical.Lock()
-	err = db.Write(batch, &opt.WriteOptions{
-		Sync: true,
-	})
+	err = db.Write(batch)
 	batch.Reset()
 	critical.Unlock()
 	return err
@@ -162,27 +159,77 @@ func decode_block_metadata(key []byte, value []byte) (block BlockMetadata) {
 	copy(block.Hash[:], value[0:32])
 	copy(block.Previous[:], value[32:64])
 	copy(block.Fingerprint[:], value[64:96])
+	if len(value) >= 176 {
+		copy(block.Header[:], value[96:176])
+	}
 	return block
 }
 
-func encode_block_metadata(data BlockMetadata) (key [8]byte, value [96]byte) {
+func encode_block_metadata(data BlockMetadata) (key [8]byte, value [176]byte) {
 	binary.BigEndian.PutUint64(key[0:8], data.Height)
 	copy(value[0:32], data.Hash[:])
 	copy(value[32:64], data.Previous[:])
 	copy(value[64:96], data.Fingerprint[:])
+	copy(value[96:176], data.Header[:])
 	return key, value
 }
 
 func db_get_version() uint16 {
 	var key [2]byte
 	var version uint16 = 1
-	if data, err := db.Get(key[:], nil); err == nil {
+	if data, err := db.Get(key[:]); err == nil {
 		version = binary.BigEndian.Uint16(data)
 	}
 	return version
 }
 
-func db_store_block(batch *leveldb.Batch, block *Block) (err error) {
+func db_meta_key(name byte) (key [9]byte) {
+	for i := 0; i < 8; i++ {
+		key[i] = 0xFF
+	}
+	key[8] = name
+	return key
+}
+
+func db_get_meta(name byte) (value []byte, err error) {
+	key := db_meta_key(name)
+	return db.Get(key[:])
+}
+
+func db_put_meta(batch *StorageBatch, name byte, value []byte) {
+	key := db_meta_key(name)
+	batch.Put(key[:], value)
+}
+
+func db_hash_key(hash [32]byte) (key [41]byte) {
+	meta := db_meta_key(DB_META_HASH_INDEX)
+	copy(key[0:9], meta[:])
+	copy(key[9:41], hash[:])
+	return key
+}
+
+func db_index_block(batch *StorageBatch, metadata BlockMetadata) {
+	var height [8]byte
+	binary.BigEndian.PutUint64(height[:], metadata.Height)
+	key := db_hash_key(metadata.Hash)
+	batch.Put(key[:], height[:])
+}
+
+func db_unindex_block(batch *StorageBatch, metadata_key []byte, metadata_value []byte) {
+	metadata := decode_block_metadata(metadata_key, metadata_value)
+	key := db_hash_key(metadata.Hash)
+	batch.Delete(key[:])
+}
+
+func db_commit_key(commit [32]byte, tag_key []byte) (key [57]byte) {
+	meta := db_meta_key(DB_META_COMMIT_INDEX)
+	copy(key[0:9], meta[:])
+	copy(key[9:41], commit[:])
+	copy(key[41:57], tag_key)
+	return key
+}
+
+func db_store_block(batch *StorageBatch, block *Block) (err error) {
 	var current_tag libcomb.Tag
 	current_tag.Height = block.Metadata.Height
 	current_tag.Order = 0
@@ -190,19 +237,35 @@ func db_store_block(batch *leveldb.Batch, block *Block) (err error) {
 	for _, commit := range block.Commits {
 		tag_data := encode_tag(current_tag)
 		batch.Put(tag_data[:], commit[:])
+		index_key := db_commit_key(commit, tag_data[:])
+		batch.Put(index_key[:], nil)
 		current_tag.Order++
 	}
 
 	key, data := encode_block_metadata(block.Metadata)
 	batch.Put(key[:], data[:])
+	db_index_block(batch, block.Metadata)
 	return err
 }
 
-func db_remove_block(batch *leveldb.Batch, height uint64) (err error) {
+func db_store_header(batch *StorageBatch, metadata BlockMetadata) {
+	//rewrite the metadata of a stored block with its header, the commits and indexes stay as they are
+	key, data := encode_block_metadata(metadata)
+	batch.Put(key[:], data[:])
+}
+
+func db_remove_block(batch *StorageBatch, height uint64) (err error) {
 	var prefix [8]byte
 	binary.BigEndian.PutUint64(prefix[:], height)
-	iter := db.NewIterator(util.BytesPrefix(prefix[:]), nil)
+	iter := db.NewIterator(storage_prefix(prefix[:]))
 	for iter.Next() {
+		switch len(iter.Key()) {
+		case DB_BLOCK_KEY_LENGTH:
+			db_unindex_block(batch, iter.Key(), iter.Value())
+		case DB_COMMIT_KEY_LENGTH:
+			index_key := db_commit_key(decode_commit(iter.Value()), iter.Key())
+			batch.Delete(index_key[:])
+		}
 		batch.Delete(iter.Key())
 	}
 	iter.Release()
@@ -212,24 +275,28 @@ func db_remove_block(batch *leveldb.Batch, height uint64) (err error) {
 	return nil
 }
 
-func db_remove_blocks_after(height uint64) (err error) {
-	var batch *leveldb.Batch = new(leveldb.Batch)
+func db_remove_blocks_after(batch *StorageBatch, height uint64) (err error) {
+	//only adds the deletes to the batch, so they can be written together with whatever replaces them
 	var prefix [8]byte
+	var limit [9]byte = db_meta_key(0)
 	binary.BigEndian.PutUint64(prefix[:], height)
-	iter := db.NewIterator(nil, nil)
-	iter.Seek(prefix[:])
+	//stop before the meta keys
+	iter := db.NewIterator(&StorageRange{Start: prefix[:], Limit: limit[:8]})
 	for iter.Next() {
+		switch len(iter.Key()) {
+		case DB_BLOCK_KEY_LENGTH:
+			db_unindex_block(batch, iter.Key(), iter.Value())
+		case DB_COMMIT_KEY_LENGTH:
+			index_key := db_commit_key(decode_commit(iter.Value()), iter.Key())
+			batch.Delete(index_key[:])
+		}
 		batch.Delete(iter.Key())
 	}
 	iter.Release()
-	if err = iter.Error(); err != nil {
-		return err
-	}
-	db_write(batch)
-	return nil
+	return iter.Error()
 }
 
-func db_process_block(batch *leveldb.Batch, block Block) (err error) {
+func db_process_block(batch *StorageBatch, block Block) (err error) {
 	if err = db_remove_block(batch, block.Metadata.Height); err != nil {
 		return err
 	}
@@ -241,43 +308,23 @@ func db_process_block(batch *leveldb.Batch, block Block) (err error) {
 }
 
 func db_get_block_metadata_by_hash(hash [32]byte) (metadata BlockMetadata) {
-	iter := db.NewIterator(nil, nil)
-	var key []byte
-	var value []byte
-	var m BlockMetadata
-	//iterate in reverse, it will be faster most of the time
-
-	for iter.Last(); iter.Valid(); iter.Prev() {
-		if len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
-			key = iter.Key()
-			value = iter.Value()
-			m = decode_block_metadata(key, value)
-			if m.Hash == hash {
-				metadata = m
-				break
-			}
-		}
+	//zero metadata if we dont have the block
+	key := db_hash_key(hash)
+	value, err := db.Get(key[:])
+	if err != nil || len(value) != 8 {
+		return metadata
 	}
-	iter.Release()
-	return metadata
+	return db_get_block_metadata_by_height(binary.BigEndian.Uint64(value))
 }
 
 func db_get_block_metadata_by_height(height uint64) (metadata BlockMetadata) {
-	var seek_key [8]byte
-	binary.BigEndian.PutUint64(seek_key[0:8], height)
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[0:8], height)
 
-	iter := db.NewIterator(nil, nil)
-	var key []byte
-	var value []byte
-
-	if ok := iter.Seek(seek_key[:]); ok {
-		key = iter.Key()
-		value = iter.Value()
-		metadata = decode_block_metadata(key, value)
+	if value, err := db.Get(key[:]); err == nil {
+		metadata = decode_block_metadata(key[:], value)
 	}
 
-	iter.Release()
-
 	return metadata
 }
 
@@ -285,7 +332,7 @@ func db_get_block_by_height(height uint64) (block BlockData) {
 	var seek_key [8]byte
 	binary.BigEndian.PutUint64(seek_key[0:8], height)
 
-	iter := db.NewIterator(nil, nil)
+	iter := db.NewIterator(nil)
 	var key []byte
 	var value []byte
 
@@ -295,15 +342,16 @@ func db_get_block_by_height(height uint64) (block BlockData) {
 		metadata := decode_block_metadata(key, value)
 		if metadata.Height == height {
 
-			// Set hash and prev
+			// Set hash, prev and header
 			block.Hash = metadata.Hash
 			block.Previous = metadata.Previous
+			block.Header = metadata.Header
 		}
 
 		for iter.Next() {
 			if len(iter.Key()) == DB_COMMIT_KEY_LENGTH {
 				// Found commit, add to block
-				block.Commits = append(block.Commits, decode_commit(value))
+				block.Commits = append(block.Commits, decode_commit(iter.Value()))
 			} else {
 				// Found next metadata, stop
 				break
@@ -316,7 +364,7 @@ func db_get_block_by_height(height uint64) (block BlockData) {
 }
 
 func db_load_blocks(start, end uint64, out chan<- Block) {
-	var iter iterator.Iterator
+	var iter StorageIterator
 	var start_bytes [8]byte
 	var end_bytes [8]byte
 	var key []byte
@@ -330,7 +378,7 @@ func db_load_blocks(start, end uint64, out chan<- Block) {
 	binary.BigEndian.PutUint64(start_bytes[:], start)
 	binary.BigEndian.PutUint64(end_bytes[:], end+1)
 
-	iter = db.NewIterator(&util.Range{Start: start_bytes[:], Limit: end_bytes[:]}, nil)
+	iter = db.NewIterator(&StorageRange{Start: start_bytes[:], Limit: end_bytes[:]})
 
 	for iter.Next() {
 		key = iter.Key()
@@ -352,17 +400,66 @@ func db_load_blocks(start, end uint64, out chan<- Block) {
 	iter.Release()
 }
 
+func db_get_checkpoint_header() (header [80]byte) {
+	//built in, or stored after it was fetched. zero if its neither
+	COMBInfo.Guard.RLock()
+	header = COMBInfo.CheckpointHeader
+	var checkpoint [32]byte = COMBInfo.Checkpoint
+	COMBInfo.Guard.RUnlock()
+	if header != [80]byte{} {
+		return header
+	}
+	value, err := db_get_meta(DB_META_CHECKPOINT_HEADER)
+	if err != nil || len(value) != 80 {
+		return header
+	}
+	copy(header[:], value)
+	if hash, _ := btc_parse_header(header); hash != checkpoint {
+		log_error("db", "stored checkpoint header is for %X, ignoring it", hash)
+		return [80]byte{}
+	}
+	return header
+}
+
 func db_load() {
 	var blocks chan Block = make(chan Block)
 	var count uint64
+	var top uint64
 	var wait sync.Mutex
 	wait.Lock()
+
+	DBInfo.CorruptedBlocks = make(map[uint64]struct{})
+	DBInfo.MissingHeaders = 0
+	DBInfo.MissingFrom = 0
+
+	if header := db_get_checkpoint_header(); header != [80]byte{} {
+		COMBInfo.Guard.Lock()
+		COMBInfo.CheckpointHeader = header
+		COMBInfo.Header = header //until the first block is loaded
+		COMBInfo.Guard.Unlock()
+	}
+
 	go func() {
 		for block := range blocks {
 			var fingerprint [32]byte = db_compute_block_fingerprint(block.Commits)
+			if block.Metadata.Height > top {
+				top = block.Metadata.Height
+			}
 			if block.Metadata.Fingerprint != fingerprint {
-				//recovery not implemented yet
-				log_panic("db", "fingerprint mismatch on block %d (%X != %X)", block.Metadata.Height, block.Metadata.Fingerprint, fingerprint)
+				log_error("db", "fingerprint mismatch on block %d (%X != %X)", block.Metadata.Height, block.Metadata.Fingerprint, fingerprint)
+				DBInfo.CorruptedBlocks[block.Metadata.Height] = struct{}{}
+			} else if block.Metadata.Hash != [32]byte{} && block.Metadata.Previous != COMBInfo.Hash && len(DBInfo.CorruptedBlocks) == 0 {
+				log_error("db", "block %d does not link to block %d", block.Metadata.Height, COMBInfo.Height)
+				DBInfo.CorruptedBlocks[block.Metadata.Height] = struct{}{}
+			}
+			if len(DBInfo.CorruptedBlocks) != 0 {
+				continue //libcomb stops at the last good block, nothing after a bad block can be loaded
+			}
+			if block.Metadata.Hash != [32]byte{} && block.Metadata.Header == [80]byte{} {
+				if DBInfo.MissingHeaders == 0 {
+					DBInfo.MissingFrom = block.Metadata.Height
+				}
+				DBInfo.MissingHeaders++
 			}
 			combcore_process_block(block)
 			count++
@@ -373,32 +470,182 @@ func db_load() {
 	wait.Lock()
 
 	log_status("db", "loaded %d blocks", count)
+	if DBInfo.MissingHeaders != 0 {
+		log_status("db", "%d blocks have no header, they will be filled in from the BTC peer", DBInfo.MissingHeaders)
+	}
+
+	if len(DBInfo.CorruptedBlocks) != 0 {
+		db_start_repair(top)
+	}
+}
+
+func db_start_repair(top uint64) {
+	//drop everything after the last good block, mining puts it back
+	var value [8]byte
+	COMBInfo.Guard.RLock()
+	var height uint64 = COMBInfo.Height
+	COMBInfo.Guard.RUnlock()
+
+	log_error("db", "%d corrupted blocks, truncating to block %d and mining up to %d again", len(DBInfo.CorruptedBlocks), height, top)
+
+	//the truncation and the repair target are written together
+	batch := new(StorageBatch)
+	if err := db_remove_blocks_after(batch, height+1); err != nil {
+		log_error("db", "failed to truncate (%s)", err.Error())
+		return
+	}
+	if top > DBInfo.RepairHeight {
+		DBInfo.RepairHeight = top
+	}
+	binary.BigEndian.PutUint64(value[:], DBInfo.RepairHeight)
+	db_put_meta(batch, DB_META_REPAIR, value[:])
+	if err := db_write(batch); err != nil {
+		log_error("db", "failed to truncate (%s)", err.Error())
+	}
+}
+
+func db_check_repair() {
+	//the repair is done once we have mined back past where the db used to end
+	if DBInfo.RepairHeight == 0 {
+		return
+	}
+	COMBInfo.Guard.RLock()
+	var height uint64 = COMBInfo.Height
+	COMBInfo.Guard.RUnlock()
+	if height < DBInfo.RepairHeight {
+		return
+	}
+
+	key := db_meta_key(DB_META_REPAIR)
+	batch := new(StorageBatch)
+	batch.Delete(key[:])
+	if err := db_write(batch); err != nil {
+		log_error("db", "failed to finish repair (%s)", err.Error())
+		return
+	}
+	log_status("db", "repair finished at block %d", height)
+	DBInfo.RepairHeight = 0
+	DBInfo.CorruptedBlocks = make(map[uint64]struct{})
 }
 
 func db_new() {
-	batch := new(leveldb.Batch)
+	batch := new(StorageBatch)
+	db_set_version(batch, DB_CURRENT_VERSION)
+	db_write(batch)
+	DBInfo.Version = DB_CURRENT_VERSION
+}
+
+func db_set_version(batch *StorageBatch, version uint16) {
 	var key [2]byte
 	var value [2]byte
-	binary.BigEndian.PutUint16(value[:], DB_CURRENT_VERSION)
+	binary.BigEndian.PutUint16(value[:], version)
 	batch.Put(key[:], value[:])
-	db_write(batch)
-	DBInfo.Version = DB_CURRENT_VERSION
+}
+
+func db_migrate_v3() (err error) {
+	//version 3 adds the hash index. its written in chunks, the version only goes in with the last one so a crash just starts over
+	var count int
+	log_status("db", "migrating to version 3 (hash index)...")
+	batch := new(StorageBatch)
+	iter := db.NewIterator(nil)
+	for iter.Next() {
+		if len(iter.Key()) != DB_BLOCK_KEY_LENGTH {
+			continue
+		}
+		db_index_block(batch, decode_block_metadata(iter.Key(), iter.Value()))
+		count++
+		if batch.Len() >= DB_MIGRATE_BATCH {
+			if err = db_write(batch); err != nil {
+				iter.Release()
+				return err
+			}
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	db_set_version(batch, 3)
+	if err = db_write(batch); err != nil {
+		return err
+	}
+	DBInfo.Version = 3
+	log_status("db", "indexed %d blocks", count)
+	return nil
+}
+
+func db_migrate_v4() (err error) {
+	//version 4 adds the commit index, chunked the same way as version 3
+	var count int
+	log_status("db", "migrating to version 4 (commit index)...")
+	batch := new(StorageBatch)
+	iter := db.NewIterator(nil)
+	for iter.Next() {
+		if len(iter.Key()) != DB_COMMIT_KEY_LENGTH {
+			continue
+		}
+		index_key := db_commit_key(decode_commit(iter.Value()), iter.Key())
+		batch.Put(index_key[:], nil)
+		count++
+		if batch.Len() >= DB_MIGRATE_BATCH {
+			if err = db_write(batch); err != nil {
+				iter.Release()
+				return err
+			}
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	db_set_version(batch, 4)
+	if err = db_write(batch); err != nil {
+		return err
+	}
+	DBInfo.Version = 4
+	log_status("db", "indexed %d commits", count)
+	return nil
 }
 
 func db_start() {
 	if db_is_new {
 		log_status("db", "new database created (version %d)", DB_CURRENT_VERSION)
 		db_new()
+		DBInfo.InitialLoad = false //nothing to load, a fresh push client takes blocks straight away
 		return
 	}
 
 	log_status("db", "started. loading...")
 
 	DBInfo.Version = db_get_version()
+	if DBInfo.Version == DB_LEGACY_VERSION {
+		if err := db_migrate_legacy(); err != nil {
+			log_panic("db", "failed to migrate legacy db, it was left untouched (%s)", err.Error())
+			os.Exit(-1)
+		}
+	}
+	if DBInfo.Version == 2 {
+		if err := db_migrate_v3(); err != nil {
+			log_panic("db", "failed to migrate to version 3 (%s)", err.Error())
+			os.Exit(-1)
+		}
+	}
+	if DBInfo.Version == 3 {
+		if err := db_migrate_v4(); err != nil {
+			log_panic("db", "failed to migrate to version 4 (%s)", err.Error())
+			os.Exit(-1)
+		}
+	}
 	if DBInfo.Version != DB_CURRENT_VERSION {
 		log_panic("db", "cannot load legacy db")
 	}
 
+	//an unfinished repair from a previous run
+	if value, err := db_get_meta(DB_META_REPAIR); err == nil && len(value) == 8 {
+		DBInfo.RepairHeight = binary.BigEndian.Uint64(value)
+		log_status("db", "database is being repaired up to block %d", DBInfo.RepairHeight)
+	}
+
 	db_load()
 	DBInfo.InitialLoad = false
 }
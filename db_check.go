@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+)
+
+type CheckIssue struct {
+	Height uint64
+	Kind   string //gap, link, order, orphan or fingerprint
+	Detail string
+}
+
+type CheckReport struct {
+	Version        uint16
+	Blocks         uint64
+	Commits        uint64
+	LastHeight     uint64 //highest block stored
+	LastGoodHeight uint64 //everything up to here is consistent
+	Issues         []CheckIssue
+	Repaired       bool
+}
+
+func db_check() (report CheckReport) {
+	//go through every block in key order, blocks are followed by their commits
+	var block *Block
+	var expected_order uint32
+	var height uint64
+	var previous [32]byte
+
+	COMBInfo.Guard.RLock()
+	height = COMBInfo.CheckpointHeight
+	previous = COMBInfo.Checkpoint
+	COMBInfo.Guard.RUnlock()
+
+	report.Version = db_get_version()
+	report.LastHeight = height
+	report.LastGoodHeight = ^uint64(0)
+	report.Issues = make([]CheckIssue, 0)
+
+	issue := func(height uint64, kind string, format string, a ...any) {
+		report.Issues = append(report.Issues, CheckIssue{height, kind, fmt.Sprintf(format, a...)})
+		if height-1 < report.LastGoodHeight {
+			report.LastGoodHeight = height - 1
+		}
+	}
+	finish := func() {
+		if block == nil {
+			return
+		}
+		if fingerprint := db_compute_block_fingerprint(block.Commits); fingerprint != block.Metadata.Fingerprint {
+			issue(block.Metadata.Height, "fingerprint", "stored %X, computed %X", block.Metadata.Fingerprint, fingerprint)
+		}
+		block = nil
+	}
+
+	iter := db.NewIterator(nil)
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		switch len(key) {
+		case DB_BLOCK_KEY_LENGTH:
+			finish()
+			block = &Block{Metadata: decode_block_metadata(key, value)}
+			expected_order = 0
+			report.Blocks++
+
+			if block.Metadata.Height != height+1 {
+				issue(height+1, "gap", "next block is %d", block.Metadata.Height)
+			}
+			if block.Metadata.Previous != previous {
+				issue(block.Metadata.Height, "link", "previous is %X, expected %X", block.Metadata.Previous, previous)
+			}
+			height = block.Metadata.Height
+			previous = block.Metadata.Hash
+			report.LastHeight = height
+		case DB_COMMIT_KEY_LENGTH:
+			tag := decode_tag(key)
+			report.Commits++
+			if block == nil || tag.Height != block.Metadata.Height {
+				issue(tag.Height, "orphan", "commit %X at order %d has no block", decode_commit(value), tag.Order)
+				continue
+			}
+			if tag.Order != expected_order {
+				issue(tag.Height, "order", "expected order %d, found %d", expected_order, tag.Order)
+			}
+			expected_order = tag.Order + 1
+			block.Commits = append(block.Commits, decode_commit(value))
+		}
+	}
+	finish()
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		issue(height+1, "gap", "cannot read past block %d (%s)", height, err.Error())
+	}
+
+	if report.LastGoodHeight > report.LastHeight {
+		report.LastGoodHeight = report.LastHeight
+	}
+	return report
+}
+
+func db_check_truncate(report *CheckReport) (err error) {
+	//drop everything after the last consistent block, mining puts it back
+	if len(report.Issues) == 0 {
+		return nil
+	}
+	log_status("db", "truncating to block %d", report.LastGoodHeight)
+	batch := new(StorageBatch)
+	if err = db_remove_blocks_after(batch, report.LastGoodHeight+1); err != nil {
+		return err
+	}
+	if err = db_write(batch); err != nil {
+		return err
+	}
+	report.Repaired = true
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// version 1 databases have no version key. they hold the same records as version 2 with different key widths:
+// blocks are a big endian height -> hash(32), previous(32), fingerprint(32, optional)
+// commits are the big endian height followed by ordering fields -> commit(32), in order within each height
+type LegacyBlock struct {
+	Key      []byte
+	Metadata BlockMetadata
+	Commits  [][32]byte
+	HasPrint bool //fingerprint was stored, so it can be verified
+}
+
+func db_legacy_height(key []byte) uint64 {
+	var height uint64
+	for _, b := range key {
+		height = (height << 8) | uint64(b)
+	}
+	return height
+}
+
+func db_legacy_read(old Storage, out func(block *LegacyBlock) error) (err error) {
+	//block keys all have the same width and commit keys start with their block key, so sorted keys
+	//give each block followed by its commits. blocks are passed on one at a time, never the whole db
+	var width int
+	var block *LegacyBlock
+
+	iter := old.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if len(key) == DB_VERSION_KEY_LENGTH {
+			continue
+		}
+		switch len(value) {
+		case 32:
+			if block == nil || len(key) <= width || !bytes.Equal(block.Key, key[:width]) {
+				return fmt.Errorf("commit %X has no block", key)
+			}
+			block.Commits = append(block.Commits, decode_commit(value))
+		case 64, 96:
+			if width == 0 {
+				width = len(key)
+			}
+			if len(key) != width || width > 8 {
+				return fmt.Errorf("unrecognised block record %X", key)
+			}
+			if block != nil {
+				if err = out(block); err != nil {
+					return err
+				}
+			}
+			block = new(LegacyBlock)
+			block.Key = append([]byte{}, key...)
+			block.Metadata.Height = db_legacy_height(key)
+			copy(block.Metadata.Hash[:], value[0:32])
+			copy(block.Metadata.Previous[:], value[32:64])
+			if len(value) == 96 {
+				copy(block.Metadata.Fingerprint[:], value[64:96])
+				block.HasPrint = true
+			}
+		default:
+			return fmt.Errorf("unrecognised record %X", key)
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("no blocks found")
+	}
+	return out(block)
+}
+
+func db_legacy_verify(previous *BlockMetadata, block *LegacyBlock) (err error) {
+	//blocks must be contiguous and linked, and match their fingerprints if they have them. previous is nil for the first block
+	var fingerprint [32]byte = db_compute_block_fingerprint(block.Commits)
+	if block.HasPrint && block.Metadata.Fingerprint != fingerprint {
+		return fmt.Errorf("fingerprint mismatch on block %d", block.Metadata.Height)
+	}
+	block.Metadata.Fingerprint = fingerprint
+	if previous == nil {
+		if block.Metadata.Previous != COMBInfo.Checkpoint {
+			return fmt.Errorf("first block does not link to the checkpoint, wrong network?")
+		}
+		return nil
+	}
+	if block.Metadata.Height != previous.Height+1 {
+		return fmt.Errorf("blocks %d to %d are missing", previous.Height+1, block.Metadata.Height-1)
+	}
+	if block.Metadata.Previous != previous.Hash {
+		return fmt.Errorf("block %d does not link to block %d", block.Metadata.Height, previous.Height)
+	}
+	return nil
+}
+
+func db_legacy_write(path string, old Storage) (first BlockMetadata, last BlockMetadata, err error) {
+	//each block is verified as its read, anything wrong and the copy is abandoned
+	var out Storage
+	var started bool
+
+	os.RemoveAll(path) //leftovers from an earlier attempt
+	if out, _, err = storage_open_leveldb(path); err != nil {
+		return first, last, err
+	}
+	defer out.Close()
+
+	batch := new(StorageBatch)
+	err = db_legacy_read(old, func(block *LegacyBlock) (err error) {
+		if !started {
+			err = db_legacy_verify(nil, block)
+			first = block.Metadata
+			started = true
+		} else {
+			err = db_legacy_verify(&last, block)
+		}
+		if err != nil {
+			return err
+		}
+		last = block.Metadata
+		if err = db_store_block(batch, &Block{block.Metadata, block.Commits}); err != nil {
+			return err
+		}
+		if batch.Len() >= DB_MIGRATE_BATCH {
+			if err = out.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return first, last, err
+	}
+	//version goes in last, an unfinished copy is never mistaken for a good one
+	db_set_version(batch, DB_CURRENT_VERSION)
+	return first, last, out.Write(batch)
+}
+
+func db_migrate_legacy() (err error) {
+	//the new database is built next to the old one, then swapped in. the old one is kept as <path>.v1
+	var first, last BlockMetadata
+	var path string = COMBInfo.Path
+
+	log_status("db", "migrating legacy database...")
+	if first, last, err = db_legacy_write(path+".migrating", db); err != nil {
+		os.RemoveAll(path + ".migrating")
+		return err
+	}
+	log_status("db", "copied %d legacy blocks (%d to %d)", last.Height-first.Height+1, first.Height, last.Height)
+
+	if err = os.Rename(path+".migrating", path+".new"); err != nil {
+		return err
+	}
+
+	db_close()
+	if err = db_finish_migration(path); err != nil {
+		return err
+	}
+	if err = db_open(); err != nil {
+		return err
+	}
+
+	DBInfo.Version = db_get_version()
+	log_status("db", "migrated to version %d", DBInfo.Version)
+	return nil
+}
+
+func db_finish_migration(path string) (err error) {
+	//also called on startup, in case we stopped halfway through the swap
+	if _, err = os.Stat(path + ".new"); err != nil {
+		return nil //nothing to finish
+	}
+	if _, err = os.Stat(path); err == nil {
+		if err = os.Rename(path, path+".v1"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path+".new", path)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"libcomb"
+	"os"
+	"testing"
+)
+
+func test_drop_indexes(t testing.TB) {
+	//back to a version 2 db, blocks and commits without either index
+	for _, name := range []byte{DB_META_HASH_INDEX, DB_META_COMMIT_INDEX} {
+		batch := new(StorageBatch)
+		meta := db_meta_key(name)
+		iter := db.NewIterator(storage_prefix(meta[:]))
+		for iter.Next() {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+		iter.Release()
+		if err := db_write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := new(StorageBatch)
+	db_set_version(batch, 2)
+	if err := db_write(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func test_migrate() (err error) {
+	//what db_start does, minus the exit
+	DBInfo.Version = db_get_version()
+	if DBInfo.Version == 2 {
+		if err = db_migrate_v3(); err != nil {
+			return err
+		}
+	}
+	if DBInfo.Version == 3 {
+		err = db_migrate_v4()
+	}
+	return err
+}
+
+func TestMigrateCrash(t *testing.T) {
+	//crash at every write of the index migrations, the version must never get ahead of the indexes
+	var finished bool
+	DB_MIGRATE_BATCH = 4
+	t.Cleanup(func() { DB_MIGRATE_BATCH = 100000 })
+	for crash := 1; !finished; crash++ {
+		t.Run(fmt.Sprintf("write %d", crash), func(t *testing.T) {
+			storage := test_crashable(t)
+			var start uint64 = COMBInfo.Height
+			chain := test_chain(t, COMBInfo.Hash, 10, 0)
+			test_ingest(t, chain)
+			test_drop_indexes(t)
+			if found := db_find_commits(test_commit(0)); len(found) != 0 {
+				t.Fatal("commit index survived")
+			}
+
+			storage.writes = 0
+			storage.crash = crash
+			err := test_migrate()
+			finished = storage.writes < crash
+			if finished && err != nil {
+				t.Fatal(err)
+			}
+			if !finished && (err == nil || db_get_version() == DB_CURRENT_VERSION) {
+				t.Fatalf("at version %d after crashing", db_get_version())
+			}
+
+			//starting again finishes the migration
+			storage.crash = 0
+			if err = test_migrate(); err != nil {
+				t.Fatal(err)
+			}
+			if version := db_get_version(); version != DB_CURRENT_VERSION {
+				t.Fatalf("at version %d", version)
+			}
+			for _, block := range chain {
+				if db_get_block_metadata_by_hash(block.Hash).Hash != block.Hash {
+					t.Fatalf("block %X is not indexed", block.Hash)
+				}
+			}
+			for i := 0; i < 2*len(chain); i++ {
+				if found := db_find_commits(test_commit(i)); len(found) != 1 || found[0].Height != start+1+uint64(i/2) {
+					t.Fatalf("commit %d found at %v", i, found)
+				}
+			}
+		})
+	}
+}
+
+func test_legacy_db(t testing.TB, path string, chain []BlockData, start uint64) {
+	//a version 1 db: no version key, 8 byte height keys, commits under the height and their order
+	old, _, err := storage_open_leveldb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(StorageBatch)
+	for i, block := range chain {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], start+1+uint64(i))
+		value := append(append([]byte{}, block.Hash[:]...), block.Previous[:]...)
+		if i%2 == 0 {
+			//only some blocks had their fingerprint stored
+			fingerprint := db_compute_block_fingerprint(block.Commits)
+			value = append(value, fingerprint[:]...)
+		}
+		batch.Put(key[:], value)
+		for order, commit := range block.Commits {
+			var commit_key [12]byte
+			copy(commit_key[0:8], key[:])
+			binary.BigEndian.PutUint32(commit_key[8:12], uint32(order))
+			batch.Put(commit_key[:], commit[:])
+		}
+	}
+	if err = old.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+}
+
+func test_leveldb_setup(t testing.TB) (path string, chain []BlockData, start uint64) {
+	//regtest on leveldb, with nothing open yet
+	test_setup(t)
+	db_close()
+	flag.Set("comb_db_engine", "leveldb")
+	t.Cleanup(func() { flag.Set("comb_db_engine", "memory") })
+	path = t.TempDir() + "/commits"
+	COMBInfo.Path = path
+	start = COMBInfo.Height
+	chain = test_chain(t, COMBInfo.Hash, 10, 0)
+	return path, chain, start
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	path, chain, start := test_leveldb_setup(t)
+	test_legacy_db(t, path, chain, start)
+	DB_MIGRATE_BATCH = 4
+	t.Cleanup(func() { DB_MIGRATE_BATCH = 100000 })
+
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	db_start()
+	if DBInfo.Version != DB_CURRENT_VERSION {
+		t.Fatalf("at version %d", DBInfo.Version)
+	}
+	if COMBInfo.Height != start+10 || COMBInfo.Hash != chain[9].Hash {
+		t.Fatalf("loaded to %X (%d)", COMBInfo.Hash, COMBInfo.Height)
+	}
+	if report := db_check(); len(report.Issues) != 0 || report.LastHeight != start+10 {
+		t.Fatal(report)
+	}
+	for i := 0; i < 2*len(chain); i++ {
+		if found := db_find_commits(test_commit(i)); len(found) != 1 || found[0].Height != start+1+uint64(i/2) {
+			t.Fatalf("commit %d found at %v", i, found)
+		}
+	}
+	if _, err := os.Stat(path + ".v1"); err != nil {
+		t.Fatal("old db was not kept", err)
+	}
+}
+
+func TestMigrateLegacyBroken(t *testing.T) {
+	//a db with a hole in it is left as it was
+	path, chain, start := test_leveldb_setup(t)
+	chain = append(chain[:4], chain[5:]...)
+	test_legacy_db(t, path, chain, start)
+
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db_migrate_legacy(); err == nil {
+		t.Fatal("migrated a broken db")
+	}
+	if version := db_get_version(); version != DB_LEGACY_VERSION {
+		t.Fatalf("at version %d", version)
+	}
+	for _, leftover := range []string{".migrating", ".new", ".v1"} {
+		if _, err := os.Stat(path + leftover); err == nil {
+			t.Fatalf("left %s behind", leftover)
+		}
+	}
+}
+
+func TestBoltEngine(t *testing.T) {
+	//a node on bolt keeps its chain and indexes across a restart
+	path, chain, start := test_leveldb_setup(t)
+	flag.Set("comb_db_engine", "bolt")
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	db_start()
+	test_ingest(t, chain)
+	db_close()
+
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	test_restart(db)
+	if COMBInfo.Height != start+10 || COMBInfo.Hash != chain[9].Hash {
+		t.Fatalf("loaded to %X (%d)", COMBInfo.Hash, COMBInfo.Height)
+	}
+	if report := db_check(); len(report.Issues) != 0 || report.LastHeight != start+10 {
+		t.Fatal(report)
+	}
+	if db_get_block_metadata_by_hash(chain[4].Hash).Height != start+5 {
+		t.Fatal("hash index was not kept")
+	}
+	if found := db_find_commits(test_commit(7)); len(found) != 1 || found[0].Height != start+4 {
+		t.Fatalf("commit index found %v", found)
+	}
+	if _, err := os.Stat(path + ".bolt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func test_check_hashes(t testing.TB, chain []BlockData, height uint64) {
+	//every block of chain is found by hash, from height
+	for i, block := range chain {
+		var reply BlockReply
+		hash := stringify_hex(block.Hash)
+		if err := new(Control).GetBlockByHash(&hash, &reply); err != nil || reply.Height != int(height)+i {
+			t.Fatalf("block %X found at %d (%v)", block.Hash, reply.Height, err)
+		}
+	}
+}
+
+func test_check_no_hashes(t testing.TB, chain []BlockData) {
+	for _, block := range chain {
+		var reply BlockReply
+		hash := stringify_hex(block.Hash)
+		if err := new(Control).GetBlockByHash(&hash, &reply); err == nil {
+			t.Fatalf("removed block %X found at %d", block.Hash, reply.Height)
+		}
+	}
+}
+
+func TestHashIndex(t *testing.T) {
+	test_setup(t)
+	var start uint64 = COMBInfo.Height
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+	test_check_hashes(t, chain, start+1)
+
+	//a reorg takes the removed blocks out
+	fork := test_chain(t, chain[5].Hash, 6, 100)
+	test_ingest(t, fork)
+	test_check_hashes(t, chain[:6], start+1)
+	test_check_hashes(t, fork, start+7)
+	test_check_no_hashes(t, chain[6:])
+
+	//migrating builds the same index from the blocks
+	test_drop_indexes(t)
+	test_check_no_hashes(t, chain[:6])
+	if err := test_migrate(); err != nil {
+		t.Fatal(err)
+	}
+	test_check_hashes(t, chain[:6], start+1)
+	test_check_hashes(t, fork, start+7)
+	test_check_no_hashes(t, chain[6:])
+}
+
+func test_check_commits(t testing.TB, chain []BlockData, height uint64, first_commit int) {
+	//every commit of chain is found once, at its location
+	for i, block := range chain {
+		for order := range block.Commits {
+			var found []CommitLocationReply
+			commit := stringify_hex(test_commit(first_commit + 2*i + order))
+			new(Control).FindCommit(&commit, &found)
+			if len(found) != 1 || found[0] != (CommitLocationReply{height + uint64(i), uint32(order), stringify_hex(block.Hash)}) {
+				t.Fatalf("commit %s found at %v", commit, found)
+			}
+		}
+	}
+}
+
+func test_check_no_commits(t testing.TB, chain []BlockData, first_commit int) {
+	for i, block := range chain {
+		for order := range block.Commits {
+			if found := db_find_commits(test_commit(first_commit + 2*i + order)); len(found) != 0 {
+				t.Fatalf("removed commit %d found at %v", first_commit+2*i+order, found)
+			}
+		}
+	}
+}
+
+func TestCommitIndex(t *testing.T) {
+	test_setup(t)
+	var start uint64 = COMBInfo.Height
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+	test_check_commits(t, chain, start+1, 0)
+
+	//a reorg takes the commits of the removed blocks out
+	fork := test_chain(t, chain[5].Hash, 6, 100)
+	test_ingest(t, fork)
+	test_check_commits(t, chain[:6], start+1, 0)
+	test_check_commits(t, fork, start+7, 100)
+	test_check_no_commits(t, chain[6:], 12)
+
+	//migrating builds the same index from the blocks
+	test_drop_indexes(t)
+	test_check_no_commits(t, chain[:6], 0)
+	if err := test_migrate(); err != nil {
+		t.Fatal(err)
+	}
+	test_check_commits(t, chain[:6], start+1, 0)
+	test_check_commits(t, fork, start+7, 100)
+	test_check_no_commits(t, chain[6:], 12)
+
+	//a commit stored again is found at both places, first one first
+	again := test_chain(t, fork[5].Hash, 1, 0)
+	test_ingest(t, again)
+	var found []CommitLocationReply
+	commit := stringify_hex(test_commit(1))
+	new(Control).FindCommit(&commit, &found)
+	if len(found) != 2 || found[0] != (CommitLocationReply{start + 1, 1, stringify_hex(chain[0].Hash)}) || found[1] != (CommitLocationReply{start + 13, 1, stringify_hex(again[0].Hash)}) {
+		t.Fatalf("duplicate commit found at %v", found)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	test_setup(t)
+	var start uint64 = COMBInfo.Height
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	//a commit of block 5 no longer matches its fingerprint
+	tag := encode_tag(libcomb.Tag{Height: start + 5, Order: 1})
+	batch := new(StorageBatch)
+	batch.Put(tag[:], make([]byte, 32))
+	if err := db_write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	//loading stops at the last good block and drops the rest
+	test_restart(db)
+	if COMBInfo.Height != start+4 || COMBInfo.Hash != chain[3].Hash {
+		t.Fatalf("loaded to %d", COMBInfo.Height)
+	}
+	if DBInfo.RepairHeight != start+10 {
+		t.Fatalf("repairing to %d", DBInfo.RepairHeight)
+	}
+	if report := db_check(); len(report.Issues) != 0 || report.LastHeight != start+4 {
+		t.Fatal(report)
+	}
+	test_check_no_hashes(t, chain[4:])
+	test_check_no_commits(t, chain[4:], 8)
+	var status StatusReply
+	new(Control).GetStatus(nil, &status)
+	if !status.Degraded || status.RepairHeight != start+10 {
+		t.Fatalf("status %v", status)
+	}
+
+	//the repair survives a restart, until the blocks are mined again
+	test_restart(db)
+	if DBInfo.RepairHeight != start+10 {
+		t.Fatalf("repairing to %d after a restart", DBInfo.RepairHeight)
+	}
+	test_use_source(t, &test_source{chain})
+	btc_sync()
+	db_check_repair()
+	if COMBInfo.Height != start+10 || DBInfo.RepairHeight != 0 {
+		t.Fatalf("at %d, repairing to %d", COMBInfo.Height, DBInfo.RepairHeight)
+	}
+	test_check_commits(t, chain, start+1, 0)
+	test_restart(db)
+	if COMBInfo.Height != start+10 || DBInfo.RepairHeight != 0 {
+		t.Fatalf("at %d, repairing to %d after a restart", COMBInfo.Height, DBInfo.RepairHeight)
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"github.com/syndtr/goleveldb/leveldb"
+	"fmt"
+	"sync"
 )
 
 var IngestInfo struct {
 	BatchCapacity uint64
 	BatchCached   uint64
-	Batch         *leveldb.Batch
+	Batch         *StorageBatch
+
+	Guard sync.Mutex //held while ingesting (btc_sync, zmq, a push or an import), they cant run together
 }
 
 func ingest_init() {
 	IngestInfo.BatchCapacity = 1000
 	IngestInfo.BatchCached = 0
-	IngestInfo.Batch = new(leveldb.Batch)
+	IngestInfo.Batch = new(StorageBatch)
 }
 
 func ingest_write() {
@@ -28,32 +31,85 @@ func ingest_write() {
 	IngestInfo.BatchCached = 0
 }
 
-func ingest_process_block(block_data BlockData) (reorg bool) {
-	var err error
+func ingest_validate_block(block_data BlockData) (err error) {
+	//check the header before anything touches the db or libcomb
+	//the merkle root was already checked against the commits when the raw block was parsed
+	//a block without a header cant be checked at all, so it never gets in
+	if block_data.Header == [80]byte{} {
+		return fmt.Errorf("block %X has no header", block_data.Hash)
+	}
+
+	var parent [80]byte
+	var height uint64
+	var found bool
+
+	COMBInfo.Guard.RLock()
+	if block_data.Previous == COMBInfo.Hash {
+		parent = COMBInfo.Header
+		height = COMBInfo.Height + 1
+		found = true
+	} else if block_data.Previous == COMBInfo.Checkpoint {
+		parent = COMBInfo.CheckpointHeader
+		height = COMBInfo.CheckpointHeight + 1
+		found = true
+	}
+	COMBInfo.Guard.RUnlock()
+
+	if !found { //reorg, find the parent in the db (the ingest batch has been flushed)
+		metadata := db_get_block_metadata_by_hash(block_data.Previous)
+		if metadata.Hash != block_data.Previous {
+			return fmt.Errorf("parent of block %X is not stored", block_data.Hash)
+		}
+		parent = metadata.Header
+		height = metadata.Height + 1
+	}
+
+	//parents stored before headers were kept get theirs from btc_fill_headers, until then nothing can go on top of them
+	if parent == [80]byte{} {
+		return fmt.Errorf("block %X cannot be checked yet, the header of its parent %X is not known", block_data.Hash, block_data.Previous)
+	}
+
+	if err = btc_validate_header(block_data.Header, block_data.Hash, block_data.Previous, parent, height); err != nil {
+		return fmt.Errorf("block %X is invalid (%s)", block_data.Hash, err.Error())
+	}
+	return nil
+}
+
+func ingest_process_block(block_data BlockData) (err error) {
 	var block Block
 	block.Metadata.Hash = block_data.Hash
 	block.Metadata.Previous = block_data.Previous
+	block.Metadata.Header = block_data.Header
 	block.Commits = block_data.Commits
 	block.Metadata.Fingerprint = db_compute_block_fingerprint(block.Commits)
 
 	//check if we already have this block
 	if _, ok := COMBInfo.Chain[block.Metadata.Hash]; ok {
 		log_status("ingest", "block discarded %X", block.Metadata.Hash)
-		return
+		return nil
 	}
 
 	//check that we have the previous block
 	if _, ok := COMBInfo.Chain[block.Metadata.Previous]; !ok {
-		log_panic("ingest", "chain broken, mining has fucked up %X, %X", block.Metadata.Hash, block.Metadata.Previous)
+		return fmt.Errorf("chain broken, block %X has unknown parent %X", block.Metadata.Hash, block.Metadata.Previous)
 	}
 
 	//if the previous block isnt the top block its a reorg
-	if block.Metadata.Previous != COMBInfo.Hash {
-		//flush the cache so we dont write back reorg'd blocks
+	var reorg bool = block.Metadata.Previous != COMBInfo.Hash
+	if reorg {
+		//flush the cache so the parent can be read back and we dont write back reorg'd blocks
 		ingest_write()
+	}
+
+	if err = ingest_validate_block(block_data); err != nil {
+		return err
+	}
 
+	if reorg {
 		//remove all the blocks after previous in the chain
-		combcore_reorg(block.Metadata.Previous)
+		if err = combcore_reorg(block.Metadata.Previous); err != nil {
+			return fmt.Errorf("reorg failed (%s)", err.Error())
+		}
 
 		//the previous block should now be the top block
 		if block.Metadata.Previous != COMBInfo.Hash {
@@ -68,7 +124,7 @@ func ingest_process_block(block_data BlockData) (reorg bool) {
 	//this doesnt touch the disk yet, just gets added to the current batch
 	if err = db_process_block(IngestInfo.Batch, block); err != nil {
 		log_panic("ingest", "store block failed (%s)", err.Error())
-		return
+		return err
 	}
 	IngestInfo.BatchCached++
 	if err = combcore_process_block(block); err != nil {
@@ -79,5 +135,5 @@ func ingest_process_block(block_data BlockData) (reorg bool) {
 		ingest_write()
 	}
 
-	return false
+	return nil
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"libcomb"
+	"testing"
+)
+
+var test_block_count uint32
+
+func test_setup(t testing.TB) {
+	//a fresh regtest node on the memory engine, replacing any node the test already set up
+	if db != nil {
+		db_close()
+	}
+	flag.Set("comb_network", "regtest")
+	flag.Set("comb_db_engine", "memory")
+	libcomb.Reset()
+	combcore_set_network()
+	ingest_init()
+	if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db != nil {
+			db_close()
+		}
+	})
+	db_start()
+}
+
+func test_commit(n int) (commit [32]byte) {
+	binary.BigEndian.PutUint64(commit[24:], uint64(n))
+	commit[0] = 0xC0
+	return commit
+}
+
+func test_raw_tx(unique uint32, commits [][32]byte) []byte {
+	//a coinbase style transaction paying to a P2WSH output for each commit
+	var tx bytes.Buffer
+	binary.Write(&tx, binary.LittleEndian, uint32(1)) //version
+	tx.Write(btc_encode_varint(1))
+	tx.Write(make([]byte, 32)) //previous txid
+	binary.Write(&tx, binary.LittleEndian, uint32(0xFFFFFFFF))
+	tx.Write(btc_encode_varint(4))
+	binary.Write(&tx, binary.LittleEndian, unique) //script, keeps every txid different
+	binary.Write(&tx, binary.LittleEndian, uint32(0xFFFFFFFF))
+	tx.Write(btc_encode_varint(uint64(len(commits))))
+	for _, commit := range commits {
+		binary.Write(&tx, binary.LittleEndian, uint64(546))
+		tx.Write(btc_encode_varint(34))
+		tx.Write([]byte{0x00, 0x20})
+		tx.Write(commit[:])
+	}
+	binary.Write(&tx, binary.LittleEndian, uint32(0)) //locktime
+	return tx.Bytes()
+}
+
+func test_raw_block(previous [32]byte, txs ...[]byte) []byte {
+	return test_raw_block_bits(previous, 0x207fffff, txs...)
+}
+
+func test_raw_block_bits(previous [32]byte, bits uint32, txs ...[]byte) []byte {
+	//a block with a header that passes proof of work on regtest
+	var txids [][32]byte
+	for _, tx := range txs {
+		txids = append(txids, btc_double_sha256(tx))
+	}
+	root, _ := btc_compute_merkle_root(txids)
+
+	var header [80]byte
+	var raw_previous [32]byte = swap_endian(previous)
+	binary.LittleEndian.PutUint32(header[0:4], 0x20000000)
+	copy(header[4:36], raw_previous[:])
+	copy(header[36:68], root[:])
+	binary.LittleEndian.PutUint32(header[68:72], 1600000000)
+	binary.LittleEndian.PutUint32(header[72:76], bits)
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(header[76:80], nonce)
+		if btc_check_pow(header) == nil {
+			break
+		}
+	}
+
+	var block bytes.Buffer
+	block.Write(header[:])
+	block.Write(btc_encode_varint(uint64(len(txs))))
+	for _, tx := range txs {
+		block.Write(tx)
+	}
+	return block.Bytes()
+}
+
+func test_block(t testing.TB, previous [32]byte, commits ...[32]byte) (block BlockData) {
+	test_block_count++
+	raw := test_raw_block(previous, test_raw_tx(test_block_count, commits))
+	if err := btc_parse_block(raw, &block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func test_chain(t testing.TB, previous [32]byte, length int, first_commit int) (chain []BlockData) {
+	//length blocks after previous, each with a couple of commits
+	for i := 0; i < length; i++ {
+		block := test_block(t, previous, test_commit(first_commit+2*i), test_commit(first_commit+2*i+1))
+		chain = append(chain, block)
+		previous = block.Hash
+	}
+	return chain
+}
+
+func test_ingest(t testing.TB, chain []BlockData) {
+	for _, block := range chain {
+		if err := ingest_process_block(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ingest_write()
+}
+
+func TestIngestMemory(t *testing.T) {
+	test_setup(t)
+	var start uint64 = COMBInfo.Height
+
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	if COMBInfo.Height != start+10 || COMBInfo.Hash != chain[9].Hash {
+		t.Fatalf("tip is %X (%d)", COMBInfo.Hash, COMBInfo.Height)
+	}
+	for i, block := range chain {
+		stored := db_get_block_by_height(start + uint64(i) + 1)
+		if stored.Hash != block.Hash || stored.Header != block.Header || len(stored.Commits) != 2 || stored.Commits[1] != block.Commits[1] {
+			t.Fatalf("block %d was not stored", i)
+		}
+	}
+	if tags := db_find_commits(test_commit(5)); len(tags) != 1 || tags[0].Height != start+3 || tags[0].Order != 1 {
+		t.Fatalf("commit found at %v", tags)
+	}
+	if report := db_check(); len(report.Issues) != 0 {
+		t.Fatal(report.Issues)
+	}
+
+	//blocks we already have are discarded, blocks that dont connect are refused
+	if err := ingest_process_block(chain[3]); err != nil || COMBInfo.Height != start+10 {
+		t.Fatal("known block was not discarded")
+	}
+	if err := ingest_process_block(test_block(t, test_commit(1), test_commit(99))); err == nil {
+		t.Fatal("block with an unknown parent was accepted")
+	}
+}
+
+func TestIngestNoHeader(t *testing.T) {
+	test_setup(t)
+	block := test_block(t, COMBInfo.Hash, test_commit(1))
+	block.Header = [80]byte{}
+	if err := ingest_process_block(block); err == nil {
+		t.Fatal("block without a header was accepted")
+	}
+	if COMBInfo.Hash == block.Hash {
+		t.Fatal("tip moved to a block without a header")
+	}
+}
+
+func test_forget_checkpoint_header() {
+	//like mainnet, where the checkpoint header isnt built in
+	COMBInfo.CheckpointHeader = [80]byte{}
+	if COMBInfo.Hash == COMBInfo.Checkpoint {
+		COMBInfo.Header = [80]byte{}
+	}
+}
+
+func TestCheckpointHeaders(t *testing.T) {
+	//the built in headers must be the checkpoints
+	t.Cleanup(func() { flag.Set("comb_network", "regtest") })
+	for _, network := range []string{"testnet", "regtest", "signet"} {
+		flag.Set("comb_network", network)
+		combcore_set_network()
+		if hash, _ := btc_parse_header(COMBInfo.CheckpointHeader); hash != COMBInfo.Checkpoint || COMBInfo.Header != COMBInfo.CheckpointHeader {
+			t.Fatalf("%s checkpoint header is for %X", network, hash)
+		}
+	}
+}
+
+func TestCheckpointHeaderUnknown(t *testing.T) {
+	//nothing goes on top of the checkpoint until its header is known, the difficulty would be unchecked
+	test_setup(t)
+	header := COMBInfo.CheckpointHeader
+	test_forget_checkpoint_header()
+	chain := test_chain(t, COMBInfo.Hash, 3, 0)
+	if err := ingest_process_block(chain[0]); err == nil {
+		t.Fatal("block on an unknown checkpoint header was accepted")
+	}
+	if err := combcore_set_checkpoint_header(chain[0].Header); err == nil {
+		t.Fatal("wrong checkpoint header was accepted")
+	}
+	if err := combcore_set_checkpoint_header(header); err != nil {
+		t.Fatal(err)
+	}
+	test_ingest(t, chain)
+	if COMBInfo.Hash != chain[2].Hash {
+		t.Fatalf("ingested to %X", COMBInfo.Hash)
+	}
+
+	//its stored, so its only fetched once
+	COMBInfo.CheckpointHeader = [80]byte{}
+	if db_get_checkpoint_header() != header {
+		t.Fatal("checkpoint header was not stored")
+	}
+}
+
+func TestIngestUnknownParentHeader(t *testing.T) {
+	//a block on a parent stored before headers were kept waits until the parents header is filled in
+	storage := test_crashable(t)
+	chain := test_chain(t, COMBInfo.Hash, 5, 0)
+	test_ingest(t, chain)
+	test_strip_header(t, COMBInfo.Height)
+	test_restart(storage)
+	if COMBInfo.Header != [80]byte{} {
+		t.Fatal("top header survived")
+	}
+
+	next := test_chain(t, chain[4].Hash, 1, 100)
+	if err := ingest_process_block(next[0]); err == nil {
+		t.Fatal("block on a parent without a header was accepted")
+	}
+	test_use_source(t, &test_source{chain})
+	btc_fill_headers()
+	if err := ingest_process_block(next[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReorgUnflushed(t *testing.T) {
+	//the parent of a reorg can still be in the ingest batch, its header must be checked all the same
+	test_setup(t)
+	COMBInfo.PowRetarget = true
+	t.Cleanup(func() { COMBInfo.PowRetarget = false })
+
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	for _, block := range chain {
+		if err := ingest_process_block(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if IngestInfo.BatchCached == 0 {
+		t.Fatal("chain was flushed already")
+	}
+
+	test_block_count++
+	var bad BlockData
+	if err := btc_parse_block(test_raw_block_bits(chain[5].Hash, 0x207ffffe, test_raw_tx(test_block_count, nil)), &bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := ingest_process_block(bad); err == nil {
+		t.Fatal("fork block with the wrong difficulty was accepted")
+	}
+
+	fork := test_chain(t, chain[5].Hash, 6, 100)
+	test_ingest(t, fork)
+	if report := db_check(); len(report.Issues) != 0 || COMBInfo.Hash != fork[5].Hash {
+		t.Fatal(report)
+	}
+}
+
+func TestReorgMemory(t *testing.T) {
+	test_setup(t)
+	var start uint64 = COMBInfo.Height
+
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	//a longer branch from block 6
+	fork := test_chain(t, chain[5].Hash, 6, 100)
+	test_ingest(t, fork)
+
+	if COMBInfo.Height != start+12 || COMBInfo.Hash != fork[5].Hash {
+		t.Fatalf("tip is %X (%d)", COMBInfo.Hash, COMBInfo.Height)
+	}
+	for _, block := range chain[6:] {
+		if metadata := db_get_block_metadata_by_hash(block.Hash); metadata.Hash != [32]byte{} {
+			t.Fatalf("reorged block %X is still indexed", block.Hash)
+		}
+	}
+	for i, block := range fork {
+		if metadata := db_get_block_metadata_by_hash(block.Hash); metadata.Height != start+7+uint64(i) {
+			t.Fatalf("block %X is at %d", block.Hash, metadata.Height)
+		}
+	}
+	if tags := db_find_commits(test_commit(19)); len(tags) != 0 {
+		t.Fatalf("reorged commit found at %v", tags)
+	}
+	if tags := db_find_commits(test_commit(100)); len(tags) != 1 || tags[0].Height != start+7 {
+		t.Fatalf("new commit found at %v", tags)
+	}
+	if report := db_check(); len(report.Issues) != 0 || report.LastHeight != start+12 {
+		t.Fatal(report)
+	}
+}
+
+// storage that loses write number crash and every write after it, like a node that died at that point
+type test_crash_storage struct {
+	*MemoryStorage
+	writes int
+	crash  int //0 never crashes
+
+	fail_iterators bool
+}
+
+type test_failed_iterator struct {
+	StorageIterator
+}
+
+func (iter test_failed_iterator) Error() error {
+	return fmt.Errorf("read failed")
+}
+
+func (s *test_crash_storage) Write(batch *StorageBatch) error {
+	s.writes++
+	if s.crash != 0 && s.writes >= s.crash {
+		return fmt.Errorf("crashed")
+	}
+	return s.MemoryStorage.Write(batch)
+}
+
+func (s *test_crash_storage) NewIterator(slice *StorageRange) StorageIterator {
+	if s.fail_iterators {
+		return test_failed_iterator{s.MemoryStorage.NewIterator(slice)}
+	}
+	return s.MemoryStorage.NewIterator(slice)
+}
+
+func test_crashable(t testing.TB) *test_crash_storage {
+	test_setup(t)
+	storage := &test_crash_storage{MemoryStorage: db.(*MemoryStorage)}
+	db = storage
+	return storage
+}
+
+func test_restart(storage Storage) {
+	//start again from whatever made it to disk
+	libcomb.Reset()
+	combcore_set_network()
+	ingest_init()
+	db = storage
+	db_is_new = false
+	DBInfo.RepairHeight = 0
+	db_start()
+}
+
+func TestReorgCrash(t *testing.T) {
+	//crash at every write of a sync that reorgs, each time the db must load as one chain or the other
+	var chain, fork []BlockData
+	var finished bool
+	for crash := 1; !finished; crash++ {
+		t.Run(fmt.Sprintf("write %d", crash), func(t *testing.T) {
+			storage := test_crashable(t)
+			var start uint64 = COMBInfo.Height
+			if chain == nil {
+				chain = test_chain(t, COMBInfo.Hash, 10, 0)
+				fork = test_chain(t, chain[5].Hash, 6, 100)
+			}
+			test_ingest(t, chain)
+
+			storage.writes = 0
+			storage.crash = crash
+			IngestInfo.BatchCapacity = 2 //rollback goes out with the first two fork blocks, then a write every two blocks
+			test_ingest(t, fork)
+			finished = storage.writes < crash
+
+			storage.crash = 0
+			test_restart(storage)
+
+			report := db_check()
+			if len(report.Issues) != 0 {
+				t.Fatal(report.Issues)
+			}
+			if COMBInfo.Height != report.LastHeight {
+				t.Fatalf("loaded to %d but the db goes to %d", COMBInfo.Height, report.LastHeight)
+			}
+			//either nothing of the reorg made it or the rollback did along with some of the new blocks
+			var on_fork bool = COMBInfo.Height > start+6 && COMBInfo.Hash == fork[COMBInfo.Height-start-7].Hash
+			if COMBInfo.Hash != chain[9].Hash && !on_fork {
+				t.Fatalf("loaded %X (%d), the rollback reached the db without the blocks replacing it", COMBInfo.Hash, COMBInfo.Height)
+			}
+
+			//syncing again finishes the reorg
+			test_ingest(t, fork)
+			if report = db_check(); len(report.Issues) != 0 || report.LastHeight != start+12 || COMBInfo.Hash != fork[5].Hash {
+				t.Fatalf("resync ended at %X (%v)", COMBInfo.Hash, report)
+			}
+		})
+	}
+}
+
+func TestReorgAbort(t *testing.T) {
+	//a rollback that cant be read from the db must not touch libcomb or queue anything
+	storage := test_crashable(t)
+	var start uint64 = COMBInfo.Height
+	chain := test_chain(t, COMBInfo.Hash, 10, 0)
+	test_ingest(t, chain)
+
+	fork := test_chain(t, chain[5].Hash, 6, 100)
+	storage.fail_iterators = true
+	if err := ingest_process_block(fork[0]); err == nil {
+		t.Fatal("reorg went ahead without removing the old blocks")
+	}
+	storage.fail_iterators = false
+
+	if COMBInfo.Height != start+10 || COMBInfo.Hash != chain[9].Hash || libcomb.GetHeight() != start+10 {
+		t.Fatalf("failed reorg moved the tip to %X (%d)", COMBInfo.Hash, COMBInfo.Height)
+	}
+	if IngestInfo.Batch.Len() != 0 {
+		t.Fatalf("failed reorg queued %d writes", IngestInfo.Batch.Len())
+	}
+
+	test_ingest(t, fork)
+	if report := db_check(); len(report.Issues) != 0 || COMBInfo.Hash != fork[5].Hash {
+		t.Fatal(report)
+	}
+}
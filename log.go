@@ -17,6 +17,11 @@ func set_log_file(path string) {
 	log.SetOutput(wrt)
 }
 
+func set_log_quiet() {
+	//only log to the file, stdout is used for output
+	log.SetOutput(LoggingInfo.file)
+}
+
 func close_log_file() {
 	LoggingInfo.file.Close()
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
 	"time"
 )
 
@@ -11,10 +14,29 @@ func main() {
 
 	combcore_set_status("Initializing...")
 
+	combcore_parse_flags()
+	if len(flag.Args()) != 0 {
+		set_log_quiet() //commands print their results to stdout, so logs only go to the file
+	}
+
 	combcore_init()
+
+	if args := flag.Args(); len(args) != 0 {
+		if err = combcore_command(args); err != nil {
+			log_error("combcore", "%s failed (%s)", args[0], err.Error())
+			fmt.Fprintf(os.Stderr, "%s failed (%s)\n", args[0], err.Error())
+			close_log_file()
+			os.Exit(-1)
+		}
+		close_log_file()
+		return
+	}
+
 	ingest_init()
-	push_init()
 	btc_init()
+	push_init() //needs the bitcoin sources
+	zmq_init()
+	mempool_init()
 
 	if err = db_open(); err != nil {
 		log_panic("db", "failed to open (%s)", err.Error())
@@ -31,11 +53,13 @@ func main() {
 			btc_sync()
 		}
 
+		db_check_repair()
+
 		if PushInfo.Enabled {
 			push_sync()
 		}
 
 		combcore_set_status("Idle")
-		time.Sleep(time.Second * 10)
+		btc_wait(time.Second * 10)
 	}
 }
@@ -5,10 +5,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
 
+// a push is cut into batches at whichever limit comes first, blocks go whole so a batch can be bigger than the byte limit
+const PUSH_MAX_BLOCKS = 1000
+const PUSH_MAX_BYTES = 16 * 1024 * 1024
+const PUSH_TIMEOUT = time.Second * 60
+
+// 2 pushes whole blocks (Control.PushRawBlocks), 1 pushed commits on their own (Control.PushBlocks)
+const PUSH_VERSION = 2
+
 var PushInfo struct {
 	IP      string
 	Port    uint16
@@ -23,6 +32,12 @@ func push_init() {
 	PushInfo.IP = *push_ip
 	PushInfo.Port = uint16(*push_port)
 
+	//the client checks every commit against the merkle root, so we push whole blocks that only bitcoin has
+	if len(BTCInfo.Sources) == 0 && BTCInfo.Direct == nil {
+		log_panic("push", "pushing needs a bitcoin source to get blocks from, set btc_peer or btc_data (or remove push_client_ip)")
+		os.Exit(-1)
+	}
+
 	log_status("push", "enabled. pushing to %s:%d", PushInfo.IP, PushInfo.Port)
 }
 
@@ -34,7 +49,7 @@ func push_sync() {
 	var err error
 	var ok bool
 	var client *http.Client = &http.Client{}
-	client.Timeout = time.Second
+	client.Timeout = PUSH_TIMEOUT
 
 	var tip [32]byte
 	if tip, err = push_get_chain_tip(client); err != nil {
@@ -85,62 +100,50 @@ func push_sync() {
 }
 
 func push_blocks(client *http.Client, start uint64, delta uint64) (err error) {
-	var batch []BlockData
-	var block BlockData
-
-	var height = start
-
-	var batch_size = uint64(1000)
-
-	for i := uint64(0); i < delta; i += batch_size {
-		batch = make([]BlockData, 0)
-		for x := uint64(0); x < batch_size && i+x < delta; x++ {
-			if start+i+x != height {
-				log_error("push", "missed some blocks")
-			}
-			height = start + i + x + 1
-
-			block = db_get_block_by_height(height)
-			batch = append(batch, block)
+	var batch []PushBlockArgs
+	var size int
+	var raw_data []byte
+
+	for height := start + 1; height <= start+delta; height++ {
+		var metadata BlockMetadata = db_get_block_metadata_by_height(height)
+		if metadata.Height != height {
+			return fmt.Errorf("block %d is not stored", height)
 		}
+		if raw_data, err = btc_get_raw_block(metadata.Hash); err != nil {
+			return err
+		}
+		batch = append(batch, PushBlockArgs{Hash: stringify_hex(metadata.Hash), Block: fmt.Sprintf("%X", raw_data)})
+		size += len(raw_data)
 
+		if len(batch) < PUSH_MAX_BLOCKS && size < PUSH_MAX_BYTES && height != start+delta {
+			continue
+		}
 		if err = push_blocks_data(client, batch); err != nil {
 			return err
 		}
+		batch = batch[:0]
+		size = 0
 
-		var progress float64 = (float64(i) / float64(delta)) * 100.0
+		var progress float64 = (float64(height-start) / float64(delta)) * 100.0
 		combcore_set_status(fmt.Sprintf("Pushing (%.2f%%)...", progress))
 	}
 	return nil
 }
 
-func push_encode_block(block BlockData) PushBlockArgs {
-	var args PushBlockArgs
-
-	args.Hash = stringify_hex(block.Hash)
-	args.Previous = stringify_hex(block.Previous)
-	args.Commits = make([]string, 0)
-
-	for _, c := range block.Commits {
-		args.Commits = append(args.Commits, stringify_hex(c))
-	}
-
-	return args
-}
-
-func push_blocks_data(client *http.Client, blocks []BlockData) (err error) {
-	var json_blocks []PushBlockArgs = make([]PushBlockArgs, 0)
-
-	for _, b := range blocks {
-		json_blocks = append(json_blocks, push_encode_block(b))
-	}
-
+func push_blocks_data(client *http.Client, blocks []PushBlockArgs) (err error) {
 	var json_args []byte
-	if json_args, err = json.Marshal(json_blocks); err != nil {
+	var args PushRawBlocksArgs = PushRawBlocksArgs{Version: PUSH_VERSION, Blocks: blocks}
+	if header := db_get_checkpoint_header(); header != [80]byte{} {
+		args.CheckpointHeader = fmt.Sprintf("%X", header)
+	}
+	if json_args, err = json.Marshal(args); err != nil {
 		return err
 	}
 
-	if _, err = push_rpc(client, "Control.PushBlocks", string(json_args)); err != nil {
+	if _, err = push_rpc(client, "Control.PushRawBlocks", string(json_args)); err != nil {
+		if strings.Contains(err.Error(), "can't find method") {
+			return fmt.Errorf("client is too old to take whole blocks, it must be upgraded to push version %d (%s)", PUSH_VERSION, err.Error())
+		}
 		return err
 	}
 
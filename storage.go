@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// returned by Storage.Get when the key isnt there, whatever the engine
+var STORAGE_NOT_FOUND = errors.New("key not found")
+
+// everything db.go needs from a key value store. keys are iterated in byte order
+// the block level helpers (db_store_block, db_get_block_by_height, db_remove_blocks_after, db_load_blocks...)
+// only go through this, so every engine gets them and tests can run ingest and reorgs without a directory
+type Storage interface {
+	Get(key []byte) ([]byte, error)
+	NewIterator(slice *StorageRange) StorageIterator //nil iterates everything
+	Write(batch *StorageBatch) error                 //all or nothing, on disk before it returns
+	Close() error
+}
+
+type StorageIterator interface {
+	First() bool
+	Next() bool
+	Seek(key []byte) bool
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// keys from Start up to but not including Limit, nil for either means no bound
+type StorageRange struct {
+	Start []byte
+	Limit []byte
+}
+
+func storage_prefix(prefix []byte) *StorageRange {
+	//every key starting with prefix
+	var limit []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			limit = append([]byte{}, prefix[:i+1]...)
+			limit[i]++
+			break
+		}
+	}
+	return &StorageRange{Start: prefix, Limit: limit}
+}
+
+type StorageOperation struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// writes that are applied together, in order
+type StorageBatch struct {
+	Operations []StorageOperation
+}
+
+func (batch *StorageBatch) Put(key []byte, value []byte) {
+	batch.Operations = append(batch.Operations, StorageOperation{append([]byte{}, key...), append([]byte{}, value...), false})
+}
+
+func (batch *StorageBatch) Delete(key []byte) {
+	batch.Operations = append(batch.Operations, StorageOperation{append([]byte{}, key...), nil, true})
+}
+
+func (batch *StorageBatch) Append(other *StorageBatch) {
+	batch.Operations = append(batch.Operations, other.Operations...)
+}
+
+func (batch *StorageBatch) Len() int {
+	return len(batch.Operations)
+}
+
+func (batch *StorageBatch) Reset() {
+	batch.Operations = batch.Operations[:0]
+}
+
+func storage_open(engine string, path string) (storage Storage, is_new bool, err error) {
+	switch engine {
+	case "leveldb":
+		return storage_open_leveldb(path)
+	case "bolt":
+		return storage_open_bolt(path + ".bolt")
+	case "memory":
+		return storage_new_memory(), true, nil
+	default:
+		return nil, false, fmt.Errorf("unknown engine %s", engine)
+	}
+}
+
+type LevelStorage struct {
+	db *leveldb.DB
+}
+
+func storage_open_leveldb(path string) (storage Storage, is_new bool, err error) {
+	var lvldb *leveldb.DB
+	var options opt.Options
+	options.Compression = opt.NoCompression
+
+	//see if a db exists
+	options.ErrorIfMissing = true
+	lvldb, err = leveldb.OpenFile(path, &options)
+
+	if err != nil {
+		options.ErrorIfMissing = false
+		//may not exist, try create one
+		lvldb, err = leveldb.OpenFile(path, &options)
+		if err == nil {
+			is_new = true
+		} else {
+			//actually was some other error
+			return nil, false, err
+		}
+	}
+	return &LevelStorage{lvldb}, is_new, nil
+}
+
+func (s *LevelStorage) Get(key []byte) ([]byte, error) {
+	value, err := s.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, STORAGE_NOT_FOUND
+	}
+	return value, err
+}
+
+func (s *LevelStorage) NewIterator(slice *StorageRange) StorageIterator {
+	if slice == nil {
+		return s.db.NewIterator(nil, nil)
+	}
+	return s.db.NewIterator(&util.Range{Start: slice.Start, Limit: slice.Limit}, nil)
+}
+
+func (s *LevelStorage) Write(batch *StorageBatch) error {
+	var lvl_batch leveldb.Batch
+	for _, operation := range batch.Operations {
+		if operation.Delete {
+			lvl_batch.Delete(operation.Key)
+		} else {
+			lvl_batch.Put(operation.Key, operation.Value)
+		}
+	}
+	return s.db.Write(&lvl_batch, &opt.WriteOptions{Sync: true})
+}
+
+func (s *LevelStorage) Close() error {
+	return s.db.Close()
+}
+
+// keeps everything in memory, for tests and nodes that dont need to keep their commits
+type MemoryStorage struct {
+	mem   *memdb.DB
+	guard sync.Mutex //batches are applied one at a time
+}
+
+func storage_new_memory() *MemoryStorage {
+	return &MemoryStorage{mem: memdb.New(comparer.DefaultComparer, 0)}
+}
+
+func (m *MemoryStorage) Get(key []byte) ([]byte, error) {
+	value, err := m.mem.Get(key)
+	if err != nil {
+		return nil, STORAGE_NOT_FOUND
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *MemoryStorage) NewIterator(slice *StorageRange) StorageIterator {
+	if slice == nil {
+		return m.mem.NewIterator(nil)
+	}
+	return m.mem.NewIterator(&util.Range{Start: slice.Start, Limit: slice.Limit})
+}
+
+func (m *MemoryStorage) Write(batch *StorageBatch) error {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for _, operation := range batch.Operations {
+		if operation.Delete {
+			m.mem.Delete(operation.Key)
+		} else {
+			m.mem.Put(operation.Key, operation.Value)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	m.mem.Reset()
+	return nil
+}
+
+// keeps everything in one bbolt file, a b+tree instead of leveldbs log structured merge tree
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// every key goes in one bucket
+var BOLT_BUCKET = []byte("combcore")
+
+// keys an iterator reads per transaction
+const BOLT_ITERATOR_CHUNK = 1000
+
+func storage_open_bolt(path string) (storage Storage, is_new bool, err error) {
+	var bdb *bolt.DB
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		is_new = true
+	}
+	//the timeout is for another process holding the file, bolt would wait forever
+	if bdb, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		return nil, false, fmt.Errorf("cannot open %s (%s)", path, err.Error())
+	}
+	if err = bdb.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(BOLT_BUCKET)
+		return err
+	}); err != nil {
+		bdb.Close()
+		return nil, false, err
+	}
+	return &BoltStorage{bdb}, is_new, nil
+}
+
+func (s *BoltStorage) Get(key []byte) (value []byte, err error) {
+	var found bool
+	err = s.db.View(func(tx *bolt.Tx) error {
+		//index keys have empty values, so look for the key rather than a nil value
+		if k, v := tx.Bucket(BOLT_BUCKET).Cursor().Seek(key); k != nil && bytes.Equal(k, key) {
+			//only valid during the transaction
+			value, found = append([]byte{}, v...), true
+		}
+		return nil
+	})
+	if err == nil && !found {
+		return nil, STORAGE_NOT_FOUND
+	}
+	return value, err
+}
+
+func (s *BoltStorage) NewIterator(slice *StorageRange) StorageIterator {
+	if slice == nil {
+		slice = &StorageRange{}
+	}
+	return &BoltIterator{db: s.db, slice: *slice}
+}
+
+func (s *BoltStorage) Write(batch *StorageBatch) error {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		bucket := tx.Bucket(BOLT_BUCKET)
+		for _, operation := range batch.Operations {
+			if operation.Delete {
+				err = bucket.Delete(operation.Key)
+			} else {
+				err = bucket.Put(operation.Key, operation.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// reads the range a chunk at a time, each chunk in its own short transaction.
+// a bolt read transaction held open while the same goroutine writes can deadlock when the file grows,
+// and the migrations write while iterating. so unlike leveldb, later chunks see writes made after the iterator was created
+type BoltIterator struct {
+	db     *bolt.DB
+	slice  StorageRange
+	keys   [][]byte
+	values [][]byte
+	index  int
+	loaded bool //positioned by First, Seek or Next
+	done   bool //nothing left after the current chunk
+	err    error
+}
+
+func (it *BoltIterator) load(from []byte, inclusive bool) bool {
+	//fill the chunk with keys from the given one onwards
+	it.keys, it.values, it.index, it.loaded = it.keys[:0], it.values[:0], 0, true
+	if it.slice.Start != nil && bytes.Compare(from, it.slice.Start) < 0 {
+		from, inclusive = it.slice.Start, true
+	}
+	it.err = it.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(BOLT_BUCKET).Cursor()
+		key, value := cursor.First()
+		if from != nil {
+			key, value = cursor.Seek(from)
+		}
+		if key != nil && !inclusive && bytes.Equal(key, from) {
+			key, value = cursor.Next()
+		}
+		for ; key != nil && len(it.keys) < BOLT_ITERATOR_CHUNK; key, value = cursor.Next() {
+			if it.slice.Limit != nil && bytes.Compare(key, it.slice.Limit) >= 0 {
+				key = nil
+				break
+			}
+			it.keys = append(it.keys, append([]byte{}, key...))
+			it.values = append(it.values, append([]byte{}, value...))
+		}
+		it.done = key == nil
+		return nil
+	})
+	if it.err != nil {
+		it.keys, it.values = it.keys[:0], it.values[:0]
+	}
+	return it.Valid()
+}
+
+func (it *BoltIterator) First() bool {
+	return it.load(it.slice.Start, true)
+}
+
+func (it *BoltIterator) Next() bool {
+	if !it.loaded {
+		//not positioned yet, like leveldb that means the first key
+		return it.First()
+	}
+	if !it.Valid() {
+		return false
+	}
+	it.index++
+	if it.index == len(it.keys) && !it.done {
+		return it.load(it.keys[it.index-1], false)
+	}
+	return it.Valid()
+}
+
+func (it *BoltIterator) Seek(key []byte) bool {
+	return it.load(key, true)
+}
+
+func (it *BoltIterator) Valid() bool {
+	return it.err == nil && it.index < len(it.keys)
+}
+
+func (it *BoltIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.keys[it.index]
+}
+
+func (it *BoltIterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+func (it *BoltIterator) Release() {
+	it.keys, it.values, it.index = nil, nil, 0
+}
+
+func (it *BoltIterator) Error() error {
+	return it.err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoragePrefix(t *testing.T) {
+	for _, c := range []struct {
+		prefix []byte
+		limit  []byte
+	}{
+		{[]byte{1, 2}, []byte{1, 3}},
+		{[]byte{1, 0xFF}, []byte{2}},
+		{[]byte{0xFF, 0xFF}, nil},
+	} {
+		if r := storage_prefix(c.prefix); !bytes.Equal(r.Start, c.prefix) || !bytes.Equal(r.Limit, c.limit) {
+			t.Errorf("prefix %X gave %X to %X", c.prefix, r.Start, r.Limit)
+		}
+	}
+}
+
+func TestStorageEngines(t *testing.T) {
+	//every engine behaves the same
+	for _, engine := range []string{"memory", "leveldb", "bolt"} {
+		t.Run(engine, func(t *testing.T) {
+			storage, is_new, err := storage_open(engine, filepath.Join(t.TempDir(), "commits"))
+			if err != nil || !is_new {
+				t.Fatal(is_new, err)
+			}
+			defer storage.Close()
+			test_storage(t, storage)
+		})
+	}
+}
+
+func test_storage(t *testing.T, storage Storage) {
+	batch := new(StorageBatch)
+	batch.Put([]byte{1}, []byte("a"))
+	batch.Put([]byte{2, 1}, []byte("b"))
+	batch.Put([]byte{2, 2}, []byte("c"))
+	batch.Put([]byte{3}, []byte("d"))
+	batch.Delete([]byte{3})
+	if err := storage.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := storage.Get([]byte{1}); err != nil || string(value) != "a" {
+		t.Fatal(value, err)
+	}
+	if _, err := storage.Get([]byte{3}); err != STORAGE_NOT_FOUND {
+		t.Fatal("deleted key was found", err)
+	}
+
+	//index keys have no value
+	batch.Put([]byte{4}, nil)
+	if err := storage.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := storage.Get([]byte{4}); err != nil || len(value) != 0 {
+		t.Fatal("empty value was not found", err)
+	}
+
+	var found string
+	iter := storage.NewIterator(storage_prefix([]byte{2}))
+	for iter.Next() {
+		found += string(iter.Value())
+	}
+	iter.Release()
+	if found != "bc" {
+		t.Fatalf("prefix iteration found %s", found)
+	}
+
+	found = ""
+	iter = storage.NewIterator(nil)
+	if iter.Seek([]byte{2, 2}) {
+		found = string(iter.Value())
+	}
+	iter.Release()
+	if found != "c" {
+		t.Fatalf("seek found %s", found)
+	}
+}
+
+func TestBoltIterator(t *testing.T) {
+	//iterating across chunks, and writing while iterating like the migrations do
+	storage, _, err := storage_open_bolt(filepath.Join(t.TempDir(), "commits.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	const count = 2*BOLT_ITERATOR_CHUNK + 1
+	batch := new(StorageBatch)
+	for i := 0; i < count; i++ {
+		var key [5]byte
+		key[0] = 1
+		binary.BigEndian.PutUint32(key[1:], uint32(i))
+		batch.Put(key[:], key[1:])
+	}
+	if err = storage.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen int
+	iter := storage.NewIterator(storage_prefix([]byte{1}))
+	for iter.Next() {
+		if binary.BigEndian.Uint32(iter.Value()) != uint32(seen) {
+			t.Fatalf("key %d was %X", seen, iter.Key())
+		}
+		seen++
+		if seen%100 == 0 {
+			batch.Put([]byte{2, byte(seen / 100)}, nil)
+			if err = storage.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	iter.Release()
+	if seen != count || iter.Error() != nil {
+		t.Fatalf("iterated %d of %d (%v)", seen, count, iter.Error())
+	}
+
+	//seeking past the first chunk, and past the end
+	iter = storage.NewIterator(storage_prefix([]byte{1}))
+	if !iter.Seek([]byte{1, 0, 0, 0x07, 0xD0}) || binary.BigEndian.Uint32(iter.Value()) != 2000 {
+		t.Fatalf("seek found %X", iter.Key())
+	}
+	if iter.Seek([]byte{2}) {
+		t.Fatalf("seek found %X outside the range", iter.Key())
+	}
+	iter.Release()
+}